@@ -0,0 +1,91 @@
+package wal
+
+import "time"
+
+// Batch is a group of records that are written to the WAL atomically: after a crash, recovery
+// either sees every record of the batch or none of them.
+//
+// A Batch does not copy the data added to it, so the data must not be modified until the batch
+// has been written.
+type Batch struct {
+	records []Record
+	// size is the total size of the records once framed (in bytes)
+	size int
+}
+
+// Add adds a record to the batch. Its time is the time the batch is written (see Record).
+func (b *Batch) Add(data []byte) {
+	b.AddRecord(Record{Data: data})
+}
+
+// AddRecord adds a record to the batch, along with its metadata. If rec.Time is zero, it is set
+// to the time the batch is written, like that of every other record of the batch without one.
+func (b *Batch) AddRecord(rec Record) {
+	b.records = append(b.records, rec)
+	b.size += frameSize(rec.metadataSize() + len(rec.Data))
+}
+
+// Len returns the number of records in the batch.
+func (b *Batch) Len() int {
+	return len(b.records)
+}
+
+// Reset empties the batch so that it can be reused.
+func (b *Batch) Reset() {
+	for i := range b.records {
+		b.records[i] = Record{}
+	}
+	b.records = b.records[:0]
+	b.size = 0
+}
+
+// WriteBatch writes every record of the batch to the current segment file and returns the index
+// assigned to the first one; the rest of the records are assigned the indices that follow.
+// A batch is never split across segments: if it doesn't fit in what is left of the current
+// segment, the segment is cut off first. To persist on disk, make sure to call Sync at some point.
+func (wal *WAL) WriteBatch(b *Batch) (uint64, error) {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	if err := wal.writable(); err != nil {
+		return 0, err
+	}
+	first := wal.lastInd + 1
+	if len(b.records) == 0 {
+		return first, nil
+	}
+
+	// Stamp the records here rather than as they are added, so that their times follow the order
+	// they are written in, along with those of other writes.
+	now := time.Now()
+	for i := range b.records {
+		if rec := &b.records[i]; rec.Time.IsZero() {
+			size := frameSize(rec.metadataSize() + len(rec.Data))
+			rec.Time = now
+			b.size += frameSize(rec.metadataSize()+len(rec.Data)) - size
+		}
+	}
+
+	// unless the segment holds no records yet, in which case cutting it would publish it empty
+	srw := wal.scratchRW
+	if size := srw.size(); size > srw.segmentReader.header.size() && size+b.size > wal.opts.SegmentSize {
+		if err := wal.cut(); err != nil {
+			return 0, err
+		}
+	}
+
+	_, err := wal.scratchRW.frameBatch(b.records)
+	if err != nil && err != errSegmentSizeReached {
+		// Part of the batch may have been written.
+		return 0, wal.fail(err)
+	}
+	wal.lastInd += uint64(len(b.records)) // keep lastInd up to date
+	wal.unsynced += len(b.records)
+	wal.notify()
+	if err == errSegmentSizeReached {
+		err = wal.cut()
+	}
+	if err == nil {
+		err = wal.applySyncPolicy()
+	}
+	return first, err
+}
@@ -0,0 +1,193 @@
+package wal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func Test_WAL_WriteBatch_RecoverFromTornBatch(t *testing.T) {
+	// Create a new WAL.
+	baseDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(baseDir)
+	walDir := filepath.Join(baseDir, "wal")
+	wal, err := OpenWAL(walDir, &Options{SegmentSize: testSegmentSize, Logger: zap.NewExample()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Write a record, followed by a batch of 3 records.
+	if _, err := wal.Write([]byte{42}); err != nil {
+		t.Fatal(err)
+	}
+	var b Batch
+	for i := 0; i < 3; i++ {
+		b.Add([]byte{byte(43 + i)})
+	}
+	first, err := wal.WriteBatch(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != 2 || wal.LastIndex() != 4 {
+		t.Fatalf("expected the batch to span [2, 4], but got [%d, %d]", first, wal.LastIndex())
+	}
+	// the batch ends the scratch segment, whether or not the record was cut off before it
+	end := wal.scratchRW.size()
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tear off the end of the last record of the batch.
+	_, scratch, err := findSegments(walDir, &wal.opts, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fName := segmentFileName(scratchDir(scratch.dir), scratch.seq, scratch.ind)
+	if err := os.Truncate(fName, int64(end-1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Open the WAL again. None of the batch should have survived.
+	wal2, err := OpenWAL(walDir, &Options{SegmentSize: testSegmentSize, Logger: zap.NewExample()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal2.Close()
+	var visited [][]byte
+	if err := wal2.Visit(func(data []byte) error {
+		visited = append(visited, data)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(visited) != 1 || visited[0][0] != 42 {
+		t.Fatalf("expected to only visit the record preceding the batch, but visited %v", visited)
+	}
+	if wal2.LastIndex() != 1 {
+		t.Fatalf("expected last index to be 1, but got %d", wal2.LastIndex())
+	}
+}
+
+func Test_WAL_WriteBatch_NeverSplit(t *testing.T) {
+	currInd := 0
+
+	// Create a new WAL.
+	baseDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(baseDir)
+	walDir := filepath.Join(baseDir, "wal")
+	wal, err := OpenWAL(walDir, &Options{SegmentSize: testSegmentSize, Logger: zap.NewExample()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	// Fill most of the first segment.
+	for wal.scratchRW.size()+frameSize(1) < testSegmentSize {
+		if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The batch doesn't fit in what is left, so it should begin a new segment.
+	var b Batch
+	for i := 0; i < 3; i++ {
+		b.Add(numAndInc(&currInd))
+	}
+	first, err := wal.WriteBatch(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wal.pubSegs) != 1 || wal.scratchRW.segment.ind != first {
+		t.Fatalf("expected the batch to begin a new segment at %d, but segments are %v and %v",
+			first, wal.pubSegs, wal.scratchRW.segment)
+	}
+
+	// A batch bigger than a whole segment gets a segment of its own, but no segment is published
+	// empty, whether the segment before it holds records or not.
+	for _, wantSegs := range []int{3, 4} {
+		var b Batch
+		for b.size <= testSegmentSize {
+			b.Add(numAndInc(&currInd))
+		}
+		first, err := wal.WriteBatch(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(wal.pubSegs) != wantSegs || wal.pubSegs[wantSegs-1].ind != first {
+			t.Fatalf("expected the batch to be segment %d, beginning at %d, but segments are %v",
+				wantSegs-1, first, wal.pubSegs)
+		}
+	}
+
+	i := 0
+	if err := wal.Visit(func(data []byte) error {
+		if string(data) != fmt.Sprintf("%d", i) {
+			return fmt.Errorf("expected %d, but got %s", i, data)
+		}
+		i++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if i != currInd {
+		t.Fatalf("read %d frames, but wrote %d frames", i, currInd)
+	}
+}
+
+func Test_WAL_WriteBatch_Time(t *testing.T) {
+	wal, err := OpenWAL("wal", &Options{FS: NewMemFS()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	// Records are given their time once the batch is written, rather than once they are added to
+	// it, so that their times follow the order they are written in. Times given to them are kept.
+	given := time.Unix(0, 42)
+	var b Batch
+	b.Add([]byte("a"))
+	b.Add([]byte("b"))
+	b.AddRecord(Record{Time: given, Data: []byte("c")})
+	time.Sleep(time.Millisecond)
+	ind, err := wal.Append([]byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wal.WriteBatch(&b); err != nil {
+		t.Fatal(err)
+	}
+	size := 0
+	for _, rec := range b.records {
+		size += frameSize(rec.metadataSize() + len(rec.Data))
+	}
+	if b.size != size {
+		t.Fatalf("expected the batch to take up %d bytes once stamped, but it took %d", size, b.size)
+	}
+
+	recs, err := wal.ReadRangeRecords(ind, ind+4, math.MaxUint64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 4 {
+		t.Fatalf("expected 4 records, but got %d", len(recs))
+	}
+	if recs[1].Time.Before(recs[0].Time) || !recs[2].Time.Equal(recs[1].Time) {
+		t.Fatalf("expected the batch to be written at one time, after %v, but got %v and %v",
+			recs[0].Time, recs[1].Time, recs[2].Time)
+	}
+	if !recs[3].Time.Equal(given) {
+		t.Fatalf("expected the given time %v, but got %v", given, recs[3].Time)
+	}
+}
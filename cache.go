@@ -0,0 +1,94 @@
+package wal
+
+import (
+	"container/list"
+	"sync"
+)
+
+// readCache keeps the records most recently read by WAL.Read and WAL.ReadRange in memory,
+// evicting the least recently used one once it holds size records.
+type readCache struct {
+	mu   sync.Mutex
+	size int
+	// lru holds the records, the most recently used one first.
+	lru     *list.List
+	entries map[uint64]*list.Element
+	// gen is bumped whenever records are discarded from the end of the WAL, so that records read
+	// beforehand aren't cached afterwards (see add).
+	gen uint64
+}
+
+func newReadCache(size int) *readCache {
+	return &readCache{
+		size:    size,
+		lru:     list.New(),
+		entries: map[uint64]*list.Element{},
+	}
+}
+
+// generation returns the current generation of the cache, to pass to add.
+func (c *readCache) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// get returns the record with the given index, if it is cached.
+func (c *readCache) get(ind uint64) (Record, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[ind]
+	if !ok {
+		return Record{}, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(Record), true
+}
+
+// add caches the record, which was read as of generation gen. If records have been discarded
+// from the end of the WAL since, it is not cached, since it may be one of them.
+func (c *readCache) add(gen uint64, rec Record) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen || c.size == 0 {
+		return
+	}
+	if e, ok := c.entries[rec.Index]; ok {
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[rec.Index] = c.lru.PushFront(rec)
+	if c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// truncateFront evicts the records preceding index.
+func (c *readCache) truncateFront(index uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeIf(func(ind uint64) bool { return ind < index })
+}
+
+// truncateBack evicts the records following index, which are about to be discarded from the WAL.
+func (c *readCache) truncateBack(index uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	c.removeIf(func(ind uint64) bool { return ind > index })
+}
+
+func (c *readCache) removeIf(f func(ind uint64) bool) {
+	for e := c.lru.Front(); e != nil; {
+		next := e.Next()
+		if f(e.Value.(Record).Index) {
+			c.remove(e)
+		}
+		e = next
+	}
+}
+
+func (c *readCache) remove(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.entries, e.Value.(Record).Index)
+}
@@ -0,0 +1,92 @@
+package wal
+
+// maxCommitGroup bounds how many AppendSync requests are committed together.
+const maxCommitGroup = 1024
+
+// commitRequest is an AppendSync request, handed over to commitLoop.
+type commitRequest struct {
+	rec Record
+
+	// ind and err are set by commitLoop before closing done.
+	ind  uint64
+	err  error
+	done chan struct{}
+}
+
+// AppendSync appends data as a new record and waits until it has been synced to disk, returning
+// the index assigned to it.
+//
+// Concurrent AppendSync calls are committed as a group: a single goroutine appends every pending
+// record and then syncs once on behalf of all of them. So rather than being capped by the
+// latency of a sync, throughput grows with the number of concurrent callers.
+func (wal *WAL) AppendSync(data []byte) (uint64, error) {
+	return wal.appendSync(Record{Data: data})
+}
+
+// AppendRecordSync is like AppendSync, but writes the record along with its metadata (see
+// Record). If rec.Time is zero, it is set to the current time.
+func (wal *WAL) AppendRecordSync(rec Record) (uint64, error) {
+	return wal.appendSync(rec)
+}
+
+func (wal *WAL) appendSync(rec Record) (uint64, error) {
+	if wal.readOnly {
+		return 0, ErrReadOnly
+	}
+	req := commitRequest{
+		rec:  rec,
+		done: make(chan struct{}),
+	}
+	select {
+	case wal.commitC <- &req:
+	case <-wal.closeC:
+		return 0, ErrClosed
+	}
+	<-req.done
+	return req.ind, req.err
+}
+
+// commitLoop commits AppendSync requests in groups, until the WAL is closed.
+func (wal *WAL) commitLoop() {
+	defer wal.wg.Done()
+	group := make([]*commitRequest, 0, maxCommitGroup)
+	for {
+		select {
+		case req := <-wal.commitC:
+			group = append(group[:0], req)
+		case <-wal.closeC:
+			return
+		}
+
+		// Gather up every other request that is waiting, without waiting for more: callers that
+		// came along while the previous group was being committed are blocked on commitC by now.
+	gather:
+		for len(group) < maxCommitGroup {
+			select {
+			case req := <-wal.commitC:
+				group = append(group, req)
+			default:
+				break gather
+			}
+		}
+
+		wal.commit(group)
+	}
+}
+
+// commit appends the data of every request in the group, then syncs once for all of them.
+func (wal *WAL) commit(group []*commitRequest) {
+	wal.mu.Lock()
+	for _, req := range group {
+		_, req.ind, req.err = wal.append(&req.rec)
+	}
+	err := wal.sync()
+	wal.mu.Unlock()
+
+	for _, req := range group {
+		if req.err == nil {
+			req.err = err
+		}
+		close(req.done)
+	}
+}
@@ -0,0 +1,148 @@
+package wal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func Test_WAL_AppendSync(t *testing.T) {
+	const (
+		nWriters = 8
+		nRecords = 50 // per writer
+	)
+
+	// Create a new WAL.
+	baseDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(baseDir)
+	walDir := filepath.Join(baseDir, "wal")
+	wal, err := OpenWAL(walDir, &Options{SegmentSize: testSegmentSize, Logger: zap.NewExample()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	written := map[uint64]string{}
+	errC := make(chan error, nWriters)
+	for w := 0; w < nWriters; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < nRecords; i++ {
+				data := fmt.Sprintf("%d-%d", w, i)
+				ind, err := wal.AppendSync([]byte(data))
+				if err != nil {
+					errC <- err
+					return
+				}
+				mu.Lock()
+				if prev, ok := written[ind]; ok {
+					mu.Unlock()
+					errC <- fmt.Errorf("index %d was assigned to both %s and %s", ind, prev, data)
+					return
+				}
+				written[ind] = data
+				mu.Unlock()
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errC)
+	for err := range errC {
+		t.Fatal(err)
+	}
+
+	// Every acknowledged record has been synced.
+	it, err := wal.ReadSyncedFrom(wal.FirstIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < nWriters*nRecords; i++ {
+		ind, data, err := it.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != written[ind] {
+			t.Fatalf("expected %s at index %d, but got %s", written[ind], ind, data)
+		}
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wal.AppendSync([]byte("closed")); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, but got %v", err)
+	}
+}
+
+// Test_WAL_AppendSync_Group checks that AppendSync requests that pile up while a group is being
+// committed are committed together, with one fsync.
+func Test_WAL_AppendSync_Group(t *testing.T) {
+	const nWriters = 16
+	fs := NewMemFS()
+	wal, err := OpenWAL("wal", &Options{SegmentSize: 4 * testSegmentSize, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	// Count the fsyncs of the scratch segment, holding up the first one until every writer is
+	// waiting on it.
+	var syncs int
+	blocked, release := make(chan struct{}), make(chan struct{})
+	fs.SetFault(func(op, name string) error {
+		if op == "Sync" && strings.Contains(name, ScratchSuffix) {
+			syncs++
+			if syncs == 1 {
+				close(blocked)
+				<-release
+			}
+		}
+		return nil
+	})
+	var wg sync.WaitGroup
+	errC := make(chan error, nWriters+1)
+	appendSync := func(data string) {
+		defer wg.Done()
+		if _, err := wal.AppendSync([]byte(data)); err != nil {
+			errC <- err
+		}
+	}
+	wg.Add(1)
+	go appendSync("first")
+	<-blocked
+	for w := 0; w < nWriters; w++ {
+		wg.Add(1)
+		go appendSync(fmt.Sprintf("%d", w))
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errC)
+	for err := range errC {
+		t.Fatal(err)
+	}
+
+	fs.SetFault(nil)
+	if syncs != 2 {
+		t.Fatalf("expected the writers to be committed with a single fsync, but got %d", syncs-1)
+	}
+	if wal.LastIndex() != nWriters+1 || wal.DurableIndex() != nWriters+1 {
+		t.Fatalf("expected %d records to be synced, but got %d of %d", nWriters+1,
+			wal.DurableIndex(), wal.LastIndex())
+	}
+}
@@ -0,0 +1,300 @@
+package wal
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// Test_WAL_Crash runs random workloads on a MemFS, crashing it every so often, and checks that
+// recovery never loses a synced record, nor brings back a torn one.
+func Test_WAL_Crash(t *testing.T) {
+	seeds := 200
+	if testing.Short() {
+		seeds = 20
+	}
+	for seed := 0; seed < seeds; seed++ {
+		seed := int64(seed)
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			testCrash(t, rand.New(rand.NewSource(seed)))
+		})
+	}
+}
+
+func testCrash(t *testing.T, r *rand.Rand) {
+	fs := NewMemFS()
+	opts := &Options{SegmentSize: 64 + r.Intn(256), FS: fs}
+	wal, err := OpenWAL("wal", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		wal.Close()
+	}()
+
+	// records[i] is the data of record i, and midBatch[i] is set if record i is followed by more
+	// records of its batch. Records up to durable are synced.
+	records := [][]byte{nil}
+	midBatch := []bool{false}
+	var first, durable uint64 = 1, 0
+	last := func() uint64 { return uint64(len(records) - 1) }
+	newRecord := func() []byte {
+		data := make([]byte, r.Intn(48))
+		r.Read(data)
+		return data
+	}
+
+	// check checks that the WAL holds records [first, upTo].
+	check := func(upTo uint64) {
+		t.Helper()
+		if wal.FirstIndex() != first || wal.LastIndex() != upTo {
+			t.Fatalf("expected the WAL to span [%d, %d], but got [%d, %d]",
+				first, upTo, wal.FirstIndex(), wal.LastIndex())
+		}
+		i := first
+		if err := wal.Visit(func(data []byte) error {
+			if !bytes.Equal(data, records[i]) {
+				return fmt.Errorf("expected record %d to be %x, but got %x", i, records[i], data)
+			}
+			i++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if i != upTo+1 {
+			t.Fatalf("expected to visit up to record %d, but visited up to %d", upTo, i-1)
+		}
+	}
+
+	for step := 0; step < 200; step++ {
+		switch op := r.Intn(20); {
+		case op < 8:
+			data := newRecord()
+			ind, err := wal.Append(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ind != last()+1 {
+				t.Fatalf("expected index %d, but got %d", last()+1, ind)
+			}
+			records = append(records, data)
+			midBatch = append(midBatch, false)
+
+		case op < 11:
+			var b Batch
+			for n := 1 + r.Intn(4); n > 0; n-- {
+				data := newRecord()
+				b.Add(data)
+				records = append(records, data)
+				midBatch = append(midBatch, n > 1)
+			}
+			if _, err := wal.WriteBatch(&b); err != nil {
+				t.Fatal(err)
+			}
+
+		case op < 13:
+			if err := wal.Sync(); err != nil {
+				t.Fatal(err)
+			}
+			durable = last()
+
+		case op < 14:
+			data := newRecord()
+			ind, err := wal.AppendSync(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			records = append(records, data)
+			midBatch = append(midBatch, false)
+			durable = ind
+
+		case op < 15:
+			index := first + uint64(r.Intn(int(last()+2-first)))
+			if err := wal.TruncateFront(index); err != nil {
+				t.Fatal(err)
+			}
+			if index > first {
+				first = index
+				durable = last()
+			}
+
+		case op < 16:
+			index := first - 1 + uint64(r.Intn(int(last()+2-first)))
+			if err := wal.TruncateBack(index); err != nil {
+				t.Fatal(err)
+			}
+			if index < last() {
+				records = records[:index+1]
+				midBatch = midBatch[:index+1]
+				midBatch[index] = false
+				durable = index
+			}
+
+		case op < 17:
+			// Reopen without crashing: nothing is lost.
+			if err := wal.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if wal, err = OpenWAL("wal", opts); err != nil {
+				t.Fatal(err)
+			}
+			check(last())
+
+		default:
+			// Crash, tearing unsynced writes, and recover. Every synced record has to survive,
+			// followed by intact records only, and never just part of a batch. The WAL may know
+			// of more synced records than the model (cutting syncs, too), which have to survive
+			// just the same.
+			if d := wal.DurableIndex(); d < durable {
+				t.Fatalf("expected durable index of at least %d, but got %d", durable, d)
+			} else {
+				durable = d
+			}
+			fs.Crash(r)
+			wal.Close()
+			if wal, err = OpenWAL("wal", opts); err != nil {
+				t.Fatal(err)
+			}
+			upTo := wal.LastIndex()
+			if upTo < durable || upTo > last() {
+				t.Fatalf("expected to recover up to [%d, %d], but recovered up to %d",
+					durable, last(), upTo)
+			}
+			if upTo > durable && midBatch[upTo] {
+				t.Fatalf("recovered part of a batch, up to %d", upTo)
+			}
+			check(upTo)
+			records = records[:upTo+1]
+			midBatch = midBatch[:upTo+1]
+			durable = upTo
+		}
+	}
+}
+
+// Test_WAL_CrashDuringPublish crashes right after a segment is renamed into the WAL directory, so
+// that it is found in both the WAL directory and the scratch directory on recovery.
+func Test_WAL_CrashDuringPublish(t *testing.T) {
+	fs := NewMemFS()
+	opts := &Options{SegmentSize: testSegmentSize, FS: fs}
+	wal, err := OpenWAL("wal", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	currInd := 0
+	for i := 0; i < 3; i++ {
+		if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := wal.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Publish the scratch segment by hand, up until the WAL directory is synced.
+	seg := wal.scratchRW.segment
+	if _, err := wal.scratchRW.seal(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Rename(
+		segmentFileName(scratchDir(seg.dir), seg.seq, seg.ind),
+		segmentFileName(seg.dir, seg.seq, seg.ind),
+	); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SyncDir(seg.dir); err != nil {
+		t.Fatal(err)
+	}
+	fs.Crash(nil)
+	wal.Close()
+
+	wal, err = OpenWAL("wal", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	if len(wal.pubSegs) != 1 || wal.scratchRW.segment.seq != 1 || wal.LastIndex() != 3 {
+		t.Fatalf("expected the published segment to be kept, but got %v and %v up to %d",
+			wal.pubSegs, wal.scratchRW.segment, wal.LastIndex())
+	}
+	_, scratches, err := getSegmentPaths(fs, "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scratches) != 1 {
+		t.Fatalf("expected the stale scratch segment to be removed, but got %v", scratches)
+	}
+}
+
+// Test_WAL_CrashDuringTruncateBack crashes part way through TruncateBack, once the scratch segment
+// and the published segments following the one holding the index have been deleted.
+func Test_WAL_CrashDuringTruncateBack(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		// fault fails TruncateBack right after the deletions, given the published segments
+		fault func(pubSegs []segment) func(string, string) error
+		// index to truncate back to, and the last index expected on recovery, given the
+		// published segments
+		index, last func(pubSegs []segment) uint64
+	}{
+		{
+			"move back to scratch",
+			func(pubSegs []segment) func(string, string) error {
+				seg := pubSegs[0]
+				return faultOn("Rename", filepath.Base(segmentFileName(seg.dir, seg.seq, seg.ind)), syscall.EIO)
+			},
+			func(pubSegs []segment) uint64 { return 1 },
+			func(pubSegs []segment) uint64 { return pubSegs[1].ind - 1 },
+		},
+		{
+			"start over",
+			func([]segment) func(string, string) error {
+				return faultOn("OpenFile", ScratchSuffix, syscall.EIO)
+			},
+			func([]segment) uint64 { return 0 },
+			func([]segment) uint64 { return 0 },
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := NewMemFS()
+			opts := &Options{SegmentSize: testSegmentSize, FS: fs}
+			wal, err := OpenWAL("wal", opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			currInd := 0
+			for len(wal.pubSegs) < 3 || wal.scratchRW.segment.ind == uint64(currInd)+1 {
+				if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := wal.Sync(); err != nil {
+				t.Fatal(err)
+			}
+			pubSegs := append([]segment{}, wal.pubSegs...)
+			fs.SetFault(tt.fault(pubSegs))
+			if err := wal.TruncateBack(tt.index(pubSegs)); err == nil {
+				t.Fatal("expected TruncateBack to fail")
+			}
+			fs.SetFault(nil)
+			fs.Crash(nil)
+			wal.Close()
+
+			// Only some of the records may have been discarded, but the WAL recovers.
+			wal, err = OpenWAL("wal", opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer wal.Close()
+			last := tt.last(pubSegs)
+			if wal.LastIndex() != last {
+				t.Fatalf("expected the WAL to end at %d, but got %d", last, wal.LastIndex())
+			}
+			if last > 0 {
+				expectRecords(t, wal, 1, last)
+			}
+		})
+	}
+}
@@ -0,0 +1,294 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// faultOn returns a fault that fails every op on files whose name contains substr with err.
+func faultOn(op, substr string, err error) func(string, string) error {
+	return func(gotOp, name string) error {
+		if gotOp == op && strings.Contains(name, substr) {
+			return err
+		}
+		return nil
+	}
+}
+
+// expectRecords checks that the WAL holds exactly the records [first, last], as written by
+// numAndInc.
+func expectRecords(t *testing.T, wal *WAL, first, last uint64) {
+	t.Helper()
+	it, err := wal.ReadFrom(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	for want := first; ; want++ {
+		ind, data, err := it.Next()
+		if err == io.EOF {
+			if want != last+1 {
+				t.Fatalf("expected records up to %d, but got up to %d", last, want-1)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ind != want || string(data) != fmt.Sprintf("%d", want-1) {
+			t.Fatalf("expected record %d, but got record %d: %s", want, ind, data)
+		}
+	}
+}
+
+func Test_WAL_Fault(t *testing.T) {
+	open := func(t *testing.T, fs *MemFS) *WAL {
+		t.Helper()
+		wal, err := OpenWAL("wal", &Options{
+			SegmentSize:     testSegmentSize,
+			WriteBufferSize: 16, // so that writes reach the file right away
+			FS:              fs,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return wal
+	}
+
+	t.Run("ENOSPC on write", func(t *testing.T) {
+		fs := NewMemFS()
+		wal := open(t, fs)
+		currInd := 0
+		for i := 0; i < 3; i++ {
+			if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := wal.Sync(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The disk fills up part way through a record. The WAL fails, so later writes and syncs
+		// fail as well, even once there is space again.
+		fs.SetFault(faultOn("Write", ScratchSuffix, syscall.ENOSPC))
+		if _, err := wal.Write([]byte("doomed")); !errors.Is(err, syscall.ENOSPC) {
+			t.Fatalf("expected ENOSPC, but got %v", err)
+		}
+		fs.SetFault(nil)
+		if _, err := wal.Write([]byte("doomed")); !errors.Is(err, syscall.ENOSPC) {
+			t.Fatalf("expected writes to keep failing with ENOSPC, but got %v", err)
+		}
+		if err := wal.Sync(); !errors.Is(err, syscall.ENOSPC) {
+			t.Fatalf("expected syncs to keep failing with ENOSPC, but got %v", err)
+		}
+		if wal.LastIndex() != 3 {
+			t.Fatalf("expected last index 3, but got %d", wal.LastIndex())
+		}
+
+		// Records written beforehand can still be read, and survive reopening, unlike the torn
+		// one.
+		expectRecords(t, wal, 1, 3)
+		if err := wal.Close(); !errors.Is(err, syscall.ENOSPC) {
+			t.Fatalf("expected Close to report ENOSPC, but got %v", err)
+		}
+		wal = open(t, fs)
+		defer wal.Close()
+		expectRecords(t, wal, 1, 3)
+		if ind, err := wal.Append(numAndInc(&currInd)); err != nil || ind != 4 {
+			t.Fatalf("expected to append record 4, but got %d (%v)", ind, err)
+		}
+	})
+
+	t.Run("EIO on fsync", func(t *testing.T) {
+		fs := NewMemFS()
+		wal := open(t, fs)
+		currInd := 0
+		if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+			t.Fatal(err)
+		}
+		fs.SetFault(faultOn("Sync", ScratchSuffix, syscall.EIO))
+		if err := wal.Sync(); !errors.Is(err, syscall.EIO) {
+			t.Fatalf("expected EIO, but got %v", err)
+		}
+
+		// Retrying mustn't report success: the written data may be gone from the page cache.
+		fs.SetFault(nil)
+		if err := wal.Sync(); !errors.Is(err, syscall.EIO) {
+			t.Fatalf("expected syncs to keep failing with EIO, but got %v", err)
+		}
+		if _, err := wal.AppendSync(numAndInc(&currInd)); !errors.Is(err, syscall.EIO) {
+			t.Fatalf("expected appends to fail with EIO, but got %v", err)
+		}
+		if err := wal.TruncateBack(0); !errors.Is(err, syscall.EIO) {
+			t.Fatalf("expected truncations to fail with EIO, but got %v", err)
+		}
+		wal.Close()
+	})
+
+	t.Run("failed rename", func(t *testing.T) {
+		fs := NewMemFS()
+		wal := open(t, fs)
+		defer wal.Close()
+
+		// Publishing fails, so the scratch segment grows past the segment size instead. The cut is
+		// only retried once per segment size, rather than on every write.
+		renames := 0
+		fs.SetFault(func(op, name string) error {
+			if op == "Rename" && strings.Contains(name, ScratchSuffix) {
+				renames++
+				return syscall.EIO
+			}
+			return nil
+		})
+		currInd := 0
+		for wal.scratchRW.size() < 3*testSegmentSize {
+			if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(wal.pubSegs) != 0 {
+			t.Fatalf("expected no published segments, but got %v", wal.pubSegs)
+		}
+		if renames == 0 || renames > 3 {
+			t.Fatalf("expected the cut to be tried once per segment size, but it was tried %d times", renames)
+		}
+
+		// Once renaming works again, the segment is published on the next try.
+		fs.SetFault(nil)
+		for len(wal.pubSegs) == 0 {
+			if wal.scratchRW.size() >= 5*testSegmentSize {
+				t.Fatalf("expected the segment to be published by now, but it is %d bytes", wal.scratchRW.size())
+			}
+			if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(wal.pubSegs) != 1 {
+			t.Fatalf("expected 1 published segment, but got %v", wal.pubSegs)
+		}
+		expectRecords(t, wal, 1, uint64(currInd))
+	})
+
+	t.Run("failed publish on open", func(t *testing.T) {
+		fs := NewMemFS()
+		wal := open(t, fs)
+
+		// Leave behind a scratch segment that is already full.
+		fs.SetFault(faultOn("Rename", ScratchSuffix, syscall.EIO))
+		currInd := 0
+		for wal.scratchRW.size() < testSegmentSize {
+			if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := wal.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Reopening can't publish it either, so it stays the scratch segment.
+		wal = open(t, fs)
+		if len(wal.pubSegs) != 0 {
+			t.Fatalf("expected no published segments, but got %v", wal.pubSegs)
+		}
+		expectRecords(t, wal, 1, uint64(currInd))
+		if err := wal.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Any other failure to publish it fails the open, without keeping the segment locked.
+		fs.SetFault(faultOn("Write", ScratchSuffix, syscall.EIO))
+		if _, err := OpenWAL("wal", &Options{SegmentSize: testSegmentSize, FS: fs}); !errors.Is(err, syscall.EIO) {
+			t.Fatalf("expected EIO, but got %v", err)
+		}
+		fs.SetFault(nil)
+		wal = open(t, fs)
+		defer wal.Close()
+		if len(wal.pubSegs) != 1 {
+			t.Fatalf("expected 1 published segment, but got %v", wal.pubSegs)
+		}
+		expectRecords(t, wal, 1, uint64(currInd))
+	})
+
+	t.Run("ENOSPC on a new segment", func(t *testing.T) {
+		fs := NewMemFS()
+		wal := open(t, fs)
+
+		// Fill the first segment, but fail to preallocate the next one.
+		currInd := 0
+		fs.SetFault(faultOn("Preallocate", ScratchSuffix, syscall.ENOSPC))
+		var err error
+		for err == nil {
+			_, err = wal.Write(numAndInc(&currInd))
+		}
+		if !errors.Is(err, syscall.ENOSPC) {
+			t.Fatalf("expected ENOSPC, but got %v", err)
+		}
+		fs.SetFault(nil)
+		if _, err := wal.Write(numAndInc(&currInd)); !errors.Is(err, syscall.ENOSPC) {
+			t.Fatalf("expected writes to keep failing with ENOSPC, but got %v", err)
+		}
+		currInd--
+
+		// The published segment holds every record, including the one that filled it.
+		expectRecords(t, wal, 1, uint64(currInd))
+		wal.Close()
+		wal = open(t, fs)
+		defer wal.Close()
+		expectRecords(t, wal, 1, uint64(currInd))
+	})
+}
+
+func Test_WAL_Err(t *testing.T) {
+	fs := NewMemFS()
+	wal, err := OpenWAL("wal", &Options{SegmentSize: testSegmentSize, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	currInd := 0
+	if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.Err(); err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+
+	// A reader flushes the buffered record, which fails. That fails the WAL too, since the
+	// record is now only partially written.
+	fs.SetFault(faultOn("Write", ScratchSuffix, syscall.EIO))
+	it, err := wal.ReadFrom(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := it.Next(); !errors.Is(err, syscall.EIO) {
+		t.Fatalf("expected EIO, but got %v", err)
+	}
+	it.Close()
+	fs.SetFault(nil)
+	latched := wal.Err()
+	if !errors.Is(latched, syscall.EIO) {
+		t.Fatalf("expected the WAL to fail with EIO, but got %v", latched)
+	}
+
+	// The first error stays latched, and is what writes and syncs fail with, even if they fail
+	// differently later on.
+	fs.SetFault(faultOn("Sync", ScratchSuffix, syscall.ENOSPC))
+	if err := wal.Sync(); err != latched {
+		t.Fatalf("expected %v, but got %v", latched, err)
+	}
+	if _, err := wal.Write(numAndInc(&currInd)); err != latched {
+		t.Fatalf("expected %v, but got %v", latched, err)
+	}
+	var b Batch
+	b.Add(numAndInc(&currInd))
+	if _, err := wal.WriteBatch(&b); err != latched {
+		t.Fatalf("expected %v, but got %v", latched, err)
+	}
+	if err := wal.Err(); err != latched {
+		t.Fatalf("expected %v, but got %v", latched, err)
+	}
+}
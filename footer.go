@@ -0,0 +1,303 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"path/filepath"
+	"time"
+)
+
+// segmentFooterMagic begins the footer of a published segment. Like segmentMagic, its last byte
+// has the msb unset, so that a footer left behind in the scratch directory by a crash in the
+// middle of publishing is mistaken for the end of the frames, and truncated by recovery.
+const segmentFooterMagic = "\x89END\r\n\x1a\n"
+
+const (
+	// segmentFooterHeadSize and segmentFooterTailSize are the sizes in bytes of the parts of a
+	// footer that precede and follow its offset table, respectively.
+	segmentFooterHeadSize = 48
+	segmentFooterTailSize = 16
+)
+
+// segmentFooter is the footer of a published segment, which follows its last frame. It is laid
+// out as follows (in little-endian):
+//  1. 8 bytes: segmentFooterMagic
+//  2. 8 bytes: number of records in the segment
+//  3. 8 bytes: index of the last record of the segment
+//  4. 4 bytes: checksum of the body of the segment, i.e. of every byte between the header and
+//     the footer
+//  5. 4 bytes: checksum of the offset table
+//  6. 8 bytes: earliest time of the records, in nanoseconds since the Unix epoch
+//  7. 8 bytes: latest time of the records, likewise
+//  8. 8 bytes per record: offset table, holding the offset of the frame of every record
+//  9. 8 bytes: offset of the footer, i.e. the size of the segment sans footer
+//  10. 4 bytes: reserved
+//  11. 4 bytes: checksum of the footer, sans offset table
+//
+// The offset of the footer comes last, so that the footer can be found from the end of the file.
+type segmentFooter struct {
+	offset        int64
+	count         uint64
+	lastInd       uint64
+	bodyChecksum  uint32
+	tableChecksum uint32
+	// minTime and maxTime bound the times of the records of the segment (see buildFooter).
+	minTime, maxTime time.Time
+}
+
+// size returns the size of the footer in bytes.
+func (ft *segmentFooter) size() int64 {
+	return segmentFooterHeadSize + 8*int64(ft.count) + segmentFooterTailSize
+}
+
+// tableOffset returns the offset of the i-th entry of the offset table.
+func (ft *segmentFooter) tableOffset(i uint64) int64 {
+	return ft.offset + segmentFooterHeadSize + 8*int64(i)
+}
+
+// encode encodes the footer, along with the offset table.
+func (ft *segmentFooter) encode(offsets []int64) []byte {
+	b := make([]byte, ft.size())
+	table := b[segmentFooterHeadSize : len(b)-segmentFooterTailSize]
+	for i, offset := range offsets {
+		binary.LittleEndian.PutUint64(table[8*i:], uint64(offset))
+	}
+	ft.tableChecksum = crc32.Checksum(table, crcTable)
+
+	head, tail := b[:segmentFooterHeadSize], b[len(b)-segmentFooterTailSize:]
+	copy(head, segmentFooterMagic)
+	binary.LittleEndian.PutUint64(head[8:], ft.count)
+	binary.LittleEndian.PutUint64(head[16:], ft.lastInd)
+	binary.LittleEndian.PutUint32(head[24:], ft.bodyChecksum)
+	binary.LittleEndian.PutUint32(head[28:], ft.tableChecksum)
+	binary.LittleEndian.PutUint64(head[32:], uint64(ft.minTime.UnixNano()))
+	binary.LittleEndian.PutUint64(head[40:], uint64(ft.maxTime.UnixNano()))
+	binary.LittleEndian.PutUint64(tail, uint64(ft.offset))
+	binary.LittleEndian.PutUint32(tail[12:], footerChecksum(head, tail))
+	return b
+}
+
+// footerChecksum returns the checksum of the footer, given the parts around its offset table.
+func footerChecksum(head, tail []byte) uint32 {
+	crc := crc32.Update(0, crcTable, head)
+	return crc32.Update(crc, crcTable, tail[:12])
+}
+
+// buildFooter computes the footer of the segment, whose frames end at offset end, from what the
+// writer has kept track of as the frames were written (see segmentReadWriter.body), so that
+// nothing has to be read back. The offset table is srw.offsets.
+//
+// The time range of the segment spans the times of its records. Records written without a time
+// were written after the segment was created and before it is sealed, now, so if there are any,
+// the range is widened to span those as well.
+func (srw *segmentReadWriter) buildFooter(end int64) *segmentFooter {
+	h := srw.segmentReader.header
+	count := uint64(len(srw.offsets))
+	minTime, maxTime := srw.minTime, srw.maxTime
+	if srw.untimed || count == 0 {
+		if minTime.IsZero() || h.created.Before(minTime) {
+			minTime = h.created
+		}
+		if now := time.Now(); now.After(maxTime) {
+			maxTime = now
+		}
+	}
+	return &segmentFooter{
+		offset:       end,
+		count:        count,
+		lastInd:      srw.segmentReader.segment.ind + count - 1,
+		bodyChecksum: srw.body.Sum32(),
+		minTime:      minTime,
+		maxTime:      maxTime,
+	}
+}
+
+// readFooter reads the footer of the segment, leaving the reader where it was.
+func (sr *segmentReader) readFooter() (*segmentFooter, error) {
+	pos, err := sr.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	size, err := sr.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	missing := fmt.Errorf("data corruption: segment footer is missing")
+	if size < int64(sr.header.size())+segmentFooterHeadSize+segmentFooterTailSize {
+		return nil, missing
+	}
+	var head [segmentFooterHeadSize]byte
+	var tail [segmentFooterTailSize]byte
+	if err := readAt(sr.f, tail[:], size-segmentFooterTailSize); err != nil {
+		return nil, err
+	}
+	offset := int64(binary.LittleEndian.Uint64(tail[:]))
+	if offset < int64(sr.header.size()) || offset > size-segmentFooterHeadSize-segmentFooterTailSize {
+		return nil, missing
+	}
+	if err := readAt(sr.f, head[:], offset); err != nil {
+		return nil, err
+	}
+	if string(head[:len(segmentFooterMagic)]) != segmentFooterMagic {
+		return nil, missing
+	}
+	if footerChecksum(head[:], tail[:]) != binary.LittleEndian.Uint32(tail[12:]) {
+		return nil, fmt.Errorf("data corruption: invalid segment footer checksum")
+	}
+	ft := segmentFooter{
+		offset:        offset,
+		count:         binary.LittleEndian.Uint64(head[8:]),
+		lastInd:       binary.LittleEndian.Uint64(head[16:]),
+		bodyChecksum:  binary.LittleEndian.Uint32(head[24:]),
+		tableChecksum: binary.LittleEndian.Uint32(head[28:]),
+		minTime:       time.Unix(0, int64(binary.LittleEndian.Uint64(head[32:]))),
+		maxTime:       time.Unix(0, int64(binary.LittleEndian.Uint64(head[40:]))),
+	}
+	if ft.offset+ft.size() != size || ft.lastInd != sr.segment.ind+ft.count-1 {
+		return nil, fmt.Errorf("data corruption: segment footer is inconsistent with the segment")
+	}
+	if _, err := sr.f.Seek(pos, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return &ft, nil
+}
+
+// framesEnd returns the offset at which the frames of the segment end, given that it has been
+// published. That is where its footer begins, if it has one.
+func (sr *segmentReader) framesEnd() (int64, error) {
+	if sr.footer != nil {
+		return sr.footer.offset, nil
+	}
+	if sr.header.version == 0 {
+		// segments without a header have no footer either
+		return math.MaxInt64, nil
+	}
+	ft, err := sr.readFooter()
+	if err != nil {
+		return 0, err
+	}
+	return ft.offset, nil
+}
+
+// seek positions the reader at the frame of the record with the given index, looking up its
+// offset in the footer, rather than reading every frame before it. The index must lie in the
+// segment.
+func (sr *segmentReader) seek(ind uint64) error {
+	i := ind - sr.segment.ind
+	if i == 0 {
+		_, err := sr.seekTo(int64(sr.header.size()), -1, sr.footer.offset)
+		return err
+	}
+	var b [16]byte
+	if err := readAt(sr.f, b[:], sr.footer.tableOffset(i-1)); err != nil {
+		return err
+	}
+	prev := int64(binary.LittleEndian.Uint64(b[:]))
+	offset := int64(binary.LittleEndian.Uint64(b[8:]))
+	if prev >= offset || offset >= sr.footer.offset {
+		return fmt.Errorf("data corruption: invalid offset of record %d in segment footer", ind)
+	}
+	_, err := sr.seekTo(offset, prev, sr.footer.offset)
+	return err
+}
+
+// seekTo positions the reader at the frame at the given offset, which directly follows the frame
+// at offset prev (or no frame at all, if prev is negative). Reads are bounded to the first limit
+// bytes of the segment, through the returned limitReader.
+func (sr *segmentReader) seekTo(offset, prev, limit int64) (*limitReader, error) {
+	// The rolling checksum picks up from the frame before, whose checksum field holds it.
+	var crc uint32
+	if prev >= 0 {
+		var b [4]byte
+		if err := readAt(sr.f, b[:], prev+8); err != nil {
+			return nil, err
+		}
+		crc = binary.LittleEndian.Uint32(b[:])
+	}
+	if _, err := sr.f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	lr := &limitReader{r: sr.f, n: offset, limit: limit}
+	sr.br.Reset(lr)
+	sr.deframer.nBytes = int(offset)
+	sr.deframer.crc = crc
+	return lr, nil
+}
+
+// verify checks the body and the offset table of the segment against the checksums in its
+// footer.
+func (sr *segmentReader) verify() error {
+	ft := sr.footer
+	if ft == nil {
+		return fmt.Errorf("segment has no footer")
+	}
+	start := int64(sr.header.size())
+	if _, err := sr.f.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	body := crc32.New(crcTable)
+	if _, err := io.CopyN(body, sr.f, ft.offset-start); err != nil {
+		return err
+	}
+	if body.Sum32() != ft.bodyChecksum {
+		return fmt.Errorf("data corruption: invalid segment body checksum")
+	}
+	table := make([]byte, 8*ft.count)
+	if err := readAt(sr.f, table, ft.tableOffset(0)); err != nil {
+		return err
+	}
+	if crc32.Checksum(table, crcTable) != ft.tableChecksum {
+		return fmt.Errorf("data corruption: invalid segment offset table checksum")
+	}
+	prev := start - 1
+	for i := uint64(0); i < ft.count; i++ {
+		offset := int64(binary.LittleEndian.Uint64(table[8*i:]))
+		if offset <= prev || offset >= ft.offset || (i == 0 && offset != start) {
+			return fmt.Errorf("data corruption: invalid offset of record %d in segment footer", sr.segment.ind+i)
+		}
+		prev = offset
+	}
+	return nil
+}
+
+// VerifySegment checks the integrity of the published segment file with the given name, against
+// the checksums in its footer, without deframing it. opts may be nil, in which case the defaults
+// are used. Segments written before headers and footers were introduced can't be verified this way.
+func VerifySegment(name string, opts *Options) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	o := opts.withDefaults()
+	seq, ind, err := getSeqInd(filepath.Base(name))
+	if err != nil {
+		return err
+	}
+	seg := segment{seq: seq, ind: ind, dir: filepath.Dir(name), opts: &o}
+	sr, err := seg.openPublished(func(r io.Reader) *bufio.Reader {
+		return bufio.NewReaderSize(r, o.ReadBufferSize)
+	})
+	if err != nil {
+		return err
+	}
+	defer sr.Close()
+	return sr.verify()
+}
+
+// readAt reads len(b) bytes of f at offset off, moving the offset of f.
+func readAt(f File, b []byte, off int64) error {
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(f, b)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("data corruption: segment is truncated")
+	}
+	return err
+}
@@ -0,0 +1,235 @@
+package wal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func Test_SegmentFooter(t *testing.T) {
+	fs := NewMemFS()
+	opts := &Options{SegmentSize: testSegmentSize, FS: fs}
+	wal, err := OpenWAL("wal", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	// Write past a few cuts, with batches in between, and with one of the cuts failing to rename
+	// the segment at first.
+	currInd := 0
+	fs.SetFault(faultOn("Rename", ScratchSuffix, syscall.EIO))
+	for len(wal.pubSegs) < 3 {
+		if wal.scratchRW.size() >= testSegmentSize {
+			fs.SetFault(nil)
+		}
+		var b Batch
+		b.Add(numAndInc(&currInd))
+		b.Add(numAndInc(&currInd))
+		if _, err := wal.WriteBatch(&b); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every published segment has a footer that describes it, through which every record can be
+	// found.
+	for i, seg := range wal.pubSegs {
+		name := segmentFileName(seg.dir, seg.seq, seg.ind)
+		if err := VerifySegment(name, opts); err != nil {
+			t.Fatal(err)
+		}
+		sr, err := seg.openPublished(wal.newPubReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		last := wal.scratchRW.segment.ind - 1
+		if i+1 < len(wal.pubSegs) {
+			last = wal.pubSegs[i+1].ind - 1
+		}
+		if ft := sr.footer; ft == nil || ft.lastInd != last || ft.count != last-seg.ind+1 {
+			t.Fatalf("expected a footer for records [%d, %d] of %s, but got %+v", seg.ind, last, name, ft)
+		}
+		for ind := seg.ind; ind <= last; ind++ {
+			if err := sr.seek(ind); err != nil {
+				t.Fatal(err)
+			}
+			data, _, err := sr.deframe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec, err := decodeRecord(ind, sr.deframer.flags, data); err != nil ||
+				string(rec.Data) != fmt.Sprintf("%d", ind-1) {
+				t.Fatalf("expected record %d, but got %s (%v)", ind, rec.Data, err)
+			}
+		}
+		sr.Close()
+	}
+	for ind := uint64(1); ind <= uint64(currInd); ind++ {
+		expectRecords(t, wal, ind, uint64(currInd))
+	}
+
+	// writeBatches writes batches and records in turn until n segments have been published.
+	writeBatches := func(wal *WAL, n int) {
+		t.Helper()
+		for len(wal.pubSegs) < n {
+			var b Batch
+			b.Add(numAndInc(&currInd))
+			b.Add(numAndInc(&currInd))
+			if _, err := wal.WriteBatch(&b); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// expectFooters checks every published segment against its footer.
+	expectFooters := func(wal *WAL) {
+		t.Helper()
+		for _, seg := range wal.pubSegs {
+			if err := VerifySegment(segmentFileName(seg.dir, seg.seq, seg.ind), opts); err != nil {
+				t.Fatal(err)
+			}
+		}
+		expectRecords(t, wal, 1, uint64(currInd))
+	}
+
+	// The footer is built from what the writer has kept track of, without reading the segment
+	// back...
+	fs.SetFault(faultOn("Read", ScratchSuffix, syscall.EIO))
+	writeBatches(wal, 4)
+	fs.SetFault(nil)
+	expectFooters(wal)
+
+	// ...which is picked up anew when a segment is truncated...
+	back := wal.pubSegs[1].ind + 1
+	if err := wal.TruncateBack(back); err != nil {
+		t.Fatal(err)
+	}
+	currInd = int(back)
+	writeBatches(wal, 3)
+	expectFooters(wal)
+
+	// ...or resumed after reopening.
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wal, err = OpenWAL("wal", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	writeBatches(wal, 5)
+	expectFooters(wal)
+}
+
+func Test_SegmentFooter_Corrupt(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		modify func(b []byte) []byte
+		err    string
+		read   bool // whether reading the segment fails too, rather than only verifying it
+	}{
+		{"body", func(b []byte) []byte { b[segmentHeaderSize+8]++; return b }, "invalid segment body checksum", false},
+		{"offset table", func(b []byte) []byte {
+			b[footerOffset(b)+segmentFooterHeadSize]++
+			return b
+		}, "invalid segment offset table checksum", false},
+		{"footer", func(b []byte) []byte { b[footerOffset(b)+8]++; return b }, "invalid segment footer checksum", true},
+		{"missing footer", func(b []byte) []byte { return b[:footerOffset(b)] }, "segment footer is missing", true},
+		{"torn footer", func(b []byte) []byte { return b[:len(b)-1] }, "segment footer is missing", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := NewMemFS()
+			opts := &Options{SegmentSize: testSegmentSize, FS: fs}
+			wal, err := OpenWAL("wal", opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			currInd := 0
+			for len(wal.pubSegs) < 1 {
+				if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := wal.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			name := segmentNames(t, fs, "wal")[0]
+			rewriteFile(t, fs, name, tt.modify)
+			if err := VerifySegment(name, opts); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected an error about %q, but got %v", tt.err, err)
+			}
+			if !tt.read {
+				return
+			}
+			wal, err = OpenWAL("wal", opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer wal.Close()
+			it, err := wal.ReadFrom(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer it.Close()
+			if _, _, err := it.Next(); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected an error about %q, but got %v", tt.err, err)
+			}
+			if _, err := wal.SeekTime(time.Now()); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected an error about %q, but got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+// Test_SegmentFooter_CrashBeforeRename crashes once the footer has been appended to the scratch
+// segment, but before the segment is renamed into the WAL directory.
+func Test_SegmentFooter_CrashBeforeRename(t *testing.T) {
+	fs := NewMemFS()
+	opts := &Options{SegmentSize: testSegmentSize, FS: fs}
+	wal, err := OpenWAL("wal", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	currInd := 0
+	for i := 0; i < 3; i++ {
+		if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := wal.scratchRW.seal(); err != nil {
+		t.Fatal(err)
+	}
+	fs.Crash(nil)
+	wal.Close()
+
+	// The footer is taken off on recovery, and put back on once the segment is published.
+	wal, err = OpenWAL("wal", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	expectRecords(t, wal, 1, uint64(currInd))
+	for len(wal.pubSegs) < 1 {
+		if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := VerifySegment(segmentNames(t, fs, "wal")[0], opts); err != nil {
+		t.Fatal(err)
+	}
+	expectRecords(t, wal, 1, uint64(currInd))
+}
+
+// footerOffset returns the offset of the footer of the given segment file contents.
+func footerOffset(b []byte) int {
+	return int(binary.LittleEndian.Uint64(b[len(b)-segmentFooterTailSize:]))
+}
@@ -3,7 +3,6 @@ package wal
 import (
 	"encoding/binary"
 	"fmt"
-	"hash"
 	"hash/crc32"
 	"io"
 )
@@ -12,6 +11,15 @@ var (
 	crcTable = crc32.MakeTable(crc32.Castagnoli)
 )
 
+const (
+	// batchFlag is set in the lenField of every frame of a batch except the last one, i.e. it
+	// means that more frames of the same batch follow.
+	batchFlag uint64 = 1 << 32
+
+	// frameFlagsMask covers the bits of the lenField that are neither the length nor the padding.
+	frameFlagsMask uint64 = 0x00ffffff00000000
+)
+
 type errorPartialFrame struct {
 	n   int
 	msg string
@@ -33,8 +41,9 @@ func (err errorChecksum) Error() string {
 }
 
 type framer struct {
-	w           io.Writer
-	crc         hash.Hash32
+	w io.Writer
+	// crc is the rolling checksum of every frame written so far
+	crc         uint32
 	lenFieldBuf [8]byte
 	checksumBuf [4]byte
 	padBuf      [8]byte
@@ -46,17 +55,31 @@ type framer struct {
 //   * most significant byte:
 //     - msb: 1 means there is padding, 0 means there is no padding
 //     - the rest: number of padding bytes (padLen)
+//   * middle 3 bytes: flags (e.g. batchFlag)
 //   * least significant 4 bytes: length of the actual data in bytes (actualLen)
 // 2. 4 bytes: uint32 checksum
-// 3. `actualLen` bytes: the actual data
+// 3. `actualLen` bytes: the actual data, which begins with the metadata of the record if the
+//    flags call for any (see recordTypeFlag and the like)
 // 4. `padLen` bytes: padding of up to 8 bytes.
 func (f *framer) frame(data []byte) (int, error) {
-	lenField, padLen := encodeFrameSize(uint32(len(data)))
+	return f.frameWithFlags(data, 0)
+}
+
+// frameWithFlags writes a frame whose lenField has the given flags set.
+func (f *framer) frameWithFlags(data []byte, flags uint64) (int, error) {
+	return f.frameWithMetadata(nil, data, flags)
+}
+
+// frameWithMetadata is like frameWithFlags, except that meta precedes data in the frame, as if
+// the two were one.
+func (f *framer) frameWithMetadata(meta, data []byte, flags uint64) (int, error) {
+	lenField, padLen := encodeFrameSize(uint32(len(meta) + len(data)))
+	lenField |= flags & frameFlagsMask
 	binary.LittleEndian.PutUint64(f.lenFieldBuf[:], lenField)
 
-	f.crc.Write(data)
-	checksum := f.crc.Sum32() // rolling
-	binary.LittleEndian.PutUint32(f.checksumBuf[:], checksum)
+	f.crc = crc32.Update(f.crc, crcTable, meta) // rolling
+	f.crc = crc32.Update(f.crc, crcTable, data)
+	binary.LittleEndian.PutUint32(f.checksumBuf[:], f.crc)
 
 	nn := 0
 
@@ -64,7 +87,7 @@ func (f *framer) frame(data []byte) (int, error) {
 	nn += n
 	f.nBytes += n
 	if n != 8 {
-		return nn, fmt.Errorf("torn write of lenField")
+		return nn, tornWrite("lenField", err)
 	}
 	if err != nil {
 		return nn, err
@@ -73,7 +96,16 @@ func (f *framer) frame(data []byte) (int, error) {
 	nn += n
 	f.nBytes += n
 	if n != 4 {
-		return nn, fmt.Errorf("torn write of checksum")
+		return nn, tornWrite("checksum", err)
+	}
+	if err != nil {
+		return nn, err
+	}
+	n, err = f.w.Write(meta)
+	nn += n
+	f.nBytes += n
+	if n != len(meta) {
+		return nn, tornWrite("metadata", err)
 	}
 	if err != nil {
 		return nn, err
@@ -82,7 +114,7 @@ func (f *framer) frame(data []byte) (int, error) {
 	nn += n
 	f.nBytes += n
 	if n != len(data) {
-		return nn, fmt.Errorf("torn write of data")
+		return nn, tornWrite("data", err)
 	}
 	if err != nil {
 		return nn, err
@@ -92,7 +124,7 @@ func (f *framer) frame(data []byte) (int, error) {
 		nn += n
 		f.nBytes += n
 		if n != int(padLen) {
-			return nn, fmt.Errorf("torn write of padding")
+			return nn, tornWrite("padding", err)
 		}
 		if err != nil {
 			return nn, err
@@ -101,10 +133,17 @@ func (f *framer) frame(data []byte) (int, error) {
 	return nn, nil
 }
 
+// tornWrite is the error for a write of part of a frame that was cut short by err (if any).
+func tornWrite(part string, err error) error {
+	if err == nil {
+		return fmt.Errorf("torn write of %s", part)
+	}
+	return fmt.Errorf("torn write of %s: %w", part, err)
+}
+
 func newFramer(w io.Writer) *framer {
 	f := framer{
-		w:   w,
-		crc: crc32.New(crcTable),
+		w: w,
 	}
 	return &f
 }
@@ -125,66 +164,75 @@ func frameSize(dataLen int) int {
 }
 
 type deframer struct {
-	r           io.Reader
-	crc         hash.Hash32
+	r io.Reader
+	// crc is the rolling checksum of every frame read so far
+	crc         uint32
 	lenFieldBuf [8]byte
 	checksumBuf [4]byte
 	padBuf      [8]byte
 	nBytes      int
+
+	// flags of the last deframed frame
+	flags uint64
 }
 
-// deframe parses a frame and returns the un-framed data. If there any issues with
+// deframe parses a frame and returns the un-framed data, metadata included. If there any issues with
 // the checksum, reading, or seeking, an error is emitted.
 // The frame is encoded as follows:
 // 1. 8 bytes:
-//   * most significant 4 bytes:
+//   * most significant byte:
 //     - msb: 1 means there is padding, 0 means there is no padding
 //     - the rest: number of padding bytes (padLen)
+//   * middle 3 bytes: flags (e.g. batchFlag)
 //   * least significant 4 bytes: length of the actual data in bytes (actualLen)
 // 2. 4 bytes: uint32 checksum
-// 3. `actualLen` bytes: the actual data
+// 3. `actualLen` bytes: the actual data, which begins with the metadata of the record if the
+//    flags call for any (see recordTypeFlag and the like)
 // 4. `padLen` bytes: padding of up to 8 bytes.
 func (d *deframer) deframe() ([]byte, int, error) {
+	// The underlying reader may return fewer bytes than asked for (e.g. at the boundary of a
+	// buffer), so every field is read with io.ReadFull. Running out of bytes part way through
+	// a frame means it is torn.
 	nn := 0
-	n, err := d.r.Read(d.lenFieldBuf[:])
+	n, err := io.ReadFull(d.r, d.lenFieldBuf[:])
 	nn += n
 	d.nBytes += n
-	if err != nil {
-		return nil, nn, err
-	} else if n != 8 {
+	if err == io.ErrUnexpectedEOF {
 		return nil, nn, errorPartialFrame{n: nn, msg: "lenField is torn"}
+	} else if err != nil {
+		return nil, nn, err
 	}
 
+	if d.lenFieldBuf[7]&0x80 == 0 {
+		// Every frame has padding, so the msb is always set. An unset msb means that this is
+		// (preallocated) space that no frame has been written to.
+		return nil, nn, errorPartialFrame{n: nn, msg: "lenField is unset"}
+	}
 	nBytes, padLen := decodeFrameSize(d.lenFieldBuf)
+	d.flags = binary.LittleEndian.Uint64(d.lenFieldBuf[:]) & frameFlagsMask
 
-	n, err = d.r.Read(d.checksumBuf[:])
+	n, err = io.ReadFull(d.r, d.checksumBuf[:])
 	nn += n
 	d.nBytes += n
-	if err != nil {
-		if err == io.EOF {
-			return nil, nn, errorPartialFrame{n: nn, msg: "checksum is torn"}
-		}
-		return nil, nn, err
-	} else if n != 4 {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
 		return nil, nn, errorPartialFrame{n: nn, msg: "checksum is torn"}
+	} else if err != nil {
+		return nil, nn, err
 	}
 	checksum := binary.LittleEndian.Uint32(d.checksumBuf[:])
 
 	data := make([]byte, nBytes)
-	n, err = d.r.Read(data)
+	n, err = io.ReadFull(d.r, data)
 	nn += n
 	d.nBytes += n
-	if err != nil {
-		if err == io.EOF {
-			return nil, nn, errorPartialFrame{n: nn, msg: "data is torn"}
-		}
-		return nil, nn, err
-	} else if n != int(nBytes) {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
 		return nil, nn, errorPartialFrame{n: nn, msg: "data is torn"}
+	} else if err != nil {
+		return nil, nn, err
 	}
 
-	d.crc.Write(data) // rolling
-	actualChecksum := d.crc.Sum32()
+	d.crc = crc32.Update(d.crc, crcTable, data) // rolling
+	actualChecksum := d.crc
 	if actualChecksum != checksum {
 		return data, nn, errorChecksum{
 			actual: actualChecksum,
@@ -195,16 +243,13 @@ func (d *deframer) deframe() ([]byte, int, error) {
 
 	if padLen > 0 {
 		// not all io.Reader's implement io.Seeker, so we don't rely on Seek() for reading past padding
-		n, err = d.r.Read(d.padBuf[:padLen])
+		n, err = io.ReadFull(d.r, d.padBuf[:padLen])
 		nn += n
 		d.nBytes += n
-		if err != nil {
-			if err == io.EOF {
-				return nil, nn, errorPartialFrame{n: nn, msg: "padding is torn"}
-			}
-			return nil, nn, err
-		} else if n != int(padLen) {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
 			return nil, nn, errorPartialFrame{n: nn, msg: "padding is torn"}
+		} else if err != nil {
+			return nil, nn, err
 		}
 	}
 
@@ -217,12 +262,19 @@ func (d *deframer) undo(n int) {
 
 func newDeframer(r io.Reader) *deframer {
 	d := deframer{
-		r:   r,
-		crc: crc32.New(crcTable),
+		r: r,
 	}
 	return &d
 }
 
+// newDeframerAt returns a deframer for frames that begin offset bytes into the segment, past its
+// header.
+func newDeframerAt(r io.Reader, offset int) *deframer {
+	d := newDeframer(r)
+	d.nBytes = offset
+	return d
+}
+
 func decodeFrameSize(lenFieldBuf [8]byte) (nBytes uint32, padLen uint8) {
 	// assuming little-endian
 	lenField := binary.LittleEndian.Uint64(lenFieldBuf[:])
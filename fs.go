@@ -0,0 +1,143 @@
+package wal
+
+import (
+	"io"
+	"os"
+	"sort"
+)
+
+// FS is the filesystem that a WAL keeps its files in. Every file and directory operation of a
+// WAL goes through its FS, so that the WAL can be backed by a storage layer other than the
+// operating system's (see Options.FS).
+//
+// Errors about missing files should satisfy os.IsNotExist, as they do for the os package.
+type FS interface {
+	// OpenFile opens the named file, like os.OpenFile.
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+
+	// Rename renames (moves) oldpath to newpath, like os.Rename.
+	Rename(oldpath, newpath string) error
+
+	// Remove removes the named file, like os.Remove.
+	Remove(name string) error
+
+	// Mkdir creates the named directory, like os.Mkdir.
+	Mkdir(name string, perm os.FileMode) error
+
+	// Stat returns a FileInfo describing the named file, like os.Stat.
+	Stat(name string) (os.FileInfo, error)
+
+	// List returns the names of the entries of the directory, in sorted order.
+	List(dir string) ([]string, error)
+
+	// SyncDir syncs the directory to disk, persisting the creation, removal, and renaming of its
+	// entries.
+	SyncDir(dir string) error
+
+	// Lock exclusively locks the named file, which must already exist. It doesn't block: if the
+	// file is already locked, ErrLocked is returned. Closing the returned io.Closer releases the
+	// lock.
+	Lock(name string) (io.Closer, error)
+
+	// RLock is like Lock, except that the lock is shared: it only conflicts with exclusive locks.
+	RLock(name string) (io.Closer, error)
+}
+
+// File is a file opened by an FS.
+type File interface {
+	io.Reader
+	io.Writer
+	io.WriterAt
+	io.Seeker
+	io.Closer
+
+	// Name returns the name of the file as given to FS.OpenFile.
+	Name() string
+
+	// Truncate changes the size of the file, like os.File's Truncate.
+	Truncate(size int64) error
+
+	// Sync commits the contents of the file to disk.
+	Sync() error
+
+	// Preallocate allocates the space for the first size bytes of the file, extending the file
+	// if it is shorter. If the operation is unsupported, no error is returned.
+	Preallocate(size int64) error
+}
+
+// OS is the FS backed by the operating system. It is the default FS of a WAL.
+var OS FS = osFS{}
+
+type osFS struct{}
+
+// OpenFile implements FS for osFS.
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return osFile{f}, nil
+}
+
+// Rename implements FS for osFS.
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+// Remove implements FS for osFS.
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+// Mkdir implements FS for osFS.
+func (osFS) Mkdir(name string, perm os.FileMode) error {
+	return os.Mkdir(name, perm)
+}
+
+// Stat implements FS for osFS.
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+// List implements FS for osFS.
+func (osFS) List(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// SyncDir implements FS for osFS.
+func (osFS) SyncDir(dir string) error {
+	dirF, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := fsync(dirF); err != nil {
+		dirF.Close()
+		return err
+	}
+	return dirF.Close()
+}
+
+// osFile is a File backed by an *os.File.
+type osFile struct {
+	*os.File
+}
+
+// Sync implements File for osFile.
+func (f osFile) Sync() error {
+	return fsync(f.File)
+}
+
+// Preallocate implements File for osFile.
+func (f osFile) Preallocate(size int64) error {
+	return preallocate(f.File, size)
+}
@@ -0,0 +1,200 @@
+package wal
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// recordingFS is an FS that records the operations performed through it.
+type recordingFS struct {
+	FS
+
+	mu  sync.Mutex
+	ops map[string]int
+}
+
+func (fs *recordingFS) record(op string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.ops == nil {
+		fs.ops = map[string]int{}
+	}
+	fs.ops[op]++
+}
+
+func (fs *recordingFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fs.record("OpenFile")
+	f, err := fs.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return recordingFile{File: f, fs: fs}, nil
+}
+
+func (fs *recordingFS) Rename(oldpath, newpath string) error {
+	fs.record("Rename")
+	return fs.FS.Rename(oldpath, newpath)
+}
+
+func (fs *recordingFS) Remove(name string) error {
+	fs.record("Remove")
+	return fs.FS.Remove(name)
+}
+
+func (fs *recordingFS) Mkdir(name string, perm os.FileMode) error {
+	fs.record("Mkdir")
+	return fs.FS.Mkdir(name, perm)
+}
+
+func (fs *recordingFS) List(dir string) ([]string, error) {
+	fs.record("List")
+	return fs.FS.List(dir)
+}
+
+func (fs *recordingFS) SyncDir(dir string) error {
+	fs.record("SyncDir")
+	return fs.FS.SyncDir(dir)
+}
+
+func (fs *recordingFS) Lock(name string) (io.Closer, error) {
+	fs.record("Lock")
+	return fs.FS.Lock(name)
+}
+
+type recordingFile struct {
+	File
+	fs *recordingFS
+}
+
+func (f recordingFile) Truncate(size int64) error {
+	f.fs.record("Truncate")
+	return f.File.Truncate(size)
+}
+
+func (f recordingFile) Sync() error {
+	f.fs.record("Sync")
+	return f.File.Sync()
+}
+
+func (f recordingFile) Preallocate(size int64) error {
+	f.fs.record("Preallocate")
+	return f.File.Preallocate(size)
+}
+
+func Test_FS(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(baseDir)
+	walDir := filepath.Join(baseDir, "wal")
+	fs := &recordingFS{FS: OS}
+	wal, err := OpenWAL(walDir, &Options{SegmentSize: testSegmentSize, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Write past a cut, sync, truncate, and read everything back.
+	currInd := 0
+	for len(wal.pubSegs) < 2 {
+		if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := wal.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.TruncateFront(wal.pubSegs[1].ind); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.TruncateBack(wal.LastIndex() - 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.Visit(func([]byte) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, op := range []string{
+		"OpenFile", "Rename", "Remove", "Mkdir", "List", "SyncDir", "Lock",
+		"Truncate", "Sync", "Preallocate",
+	} {
+		if fs.ops[op] == 0 {
+			t.Errorf("expected %s to go through the FS, but it didn't", op)
+		}
+	}
+}
+
+func Test_OS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// List returns sorted names, and reports missing directories as such.
+	for _, name := range []string{"b", "c", "a"} {
+		f, err := OS.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE, privateFileMode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	names, err := OS.List(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("expected %v, but got %v", want, names)
+	}
+	if _, err := OS.List(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Fatalf("expected a not-exist error, but got %v", err)
+	}
+
+	// A file can only be locked once at a time.
+	l, err := OS.Lock(filepath.Join(dir, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OS.Lock(filepath.Join(dir, "a")); err != ErrLocked {
+		t.Fatalf("expected ErrLocked, but got %v", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	l, err = OS.Lock(filepath.Join(dir, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Shared locks only conflict with exclusive ones.
+	if _, err := OS.RLock(filepath.Join(dir, "a")); err != ErrLocked {
+		t.Fatalf("expected ErrLocked, but got %v", err)
+	}
+	l.Close()
+	r1, err := OS.RLock(filepath.Join(dir, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := OS.RLock(filepath.Join(dir, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OS.Lock(filepath.Join(dir, "a")); err != ErrLocked {
+		t.Fatalf("expected ErrLocked, but got %v", err)
+	}
+	r1.Close()
+	r2.Close()
+	l, err = OS.Lock(filepath.Join(dir, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+}
@@ -0,0 +1,140 @@
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// segmentMagic begins the header of every segment file. Its last byte has the msb unset, so it
+// can't be mistaken for the lenField of a frame, which is what segments without a header begin
+// with.
+const segmentMagic = "\x89WAL\r\n\x1a\n"
+
+const (
+	// segmentFormatVersion is the version of the segment format written by this package: segments
+	// with a header, a footer once they are published (see segmentFooter), and record metadata
+	// (see Record). Version 0 stands for segments written before headers were introduced, which
+	// have no footer either, and are still read.
+	segmentFormatVersion = 1
+
+	// segmentHeaderSize is the size of a segment header in bytes. It is a multiple of 8, so that
+	// the frames that follow stay aligned.
+	segmentHeaderSize = 48
+)
+
+// Checksum algorithms of frames, as recorded in segment headers.
+const (
+	checksumCRC32C = 1
+)
+
+// Compression algorithms of frame data, as recorded in segment headers.
+const (
+	compressionNone = 0
+)
+
+// segmentHeader is the header of a segment file, which precedes its first frame. It is laid out
+// as follows (in little-endian):
+//  1. 8 bytes: segmentMagic
+//  2. 2 bytes: format version
+//  3. 1 byte: checksum algorithm
+//  4. 1 byte: compression algorithm
+//  5. 4 bytes: reserved
+//  6. 8 bytes: seq of the segment
+//  7. 8 bytes: index of the first record of the segment
+//  8. 8 bytes: creation time, in nanoseconds since the Unix epoch
+//  9. 4 bytes: reserved
+//  10. 4 bytes: checksum of the preceding bytes of the header
+//
+// The zero segmentHeader stands for a segment without a header.
+type segmentHeader struct {
+	version     uint16
+	checksum    uint8
+	compression uint8
+	seq, ind    uint64
+	created     time.Time
+}
+
+// newSegmentHeader returns the header of a new segment.
+func newSegmentHeader(seq, ind uint64) segmentHeader {
+	return segmentHeader{
+		version:     segmentFormatVersion,
+		checksum:    checksumCRC32C,
+		compression: compressionNone,
+		seq:         seq,
+		ind:         ind,
+		created:     time.Now(),
+	}
+}
+
+// size returns the size of the header in bytes, i.e. the offset of the first frame.
+func (h segmentHeader) size() int {
+	if h.version == 0 {
+		return 0
+	}
+	return segmentHeaderSize
+}
+
+func (h segmentHeader) encode() []byte {
+	b := make([]byte, segmentHeaderSize)
+	copy(b, segmentMagic)
+	binary.LittleEndian.PutUint16(b[8:], h.version)
+	b[10] = h.checksum
+	b[11] = h.compression
+	binary.LittleEndian.PutUint64(b[16:], h.seq)
+	binary.LittleEndian.PutUint64(b[24:], h.ind)
+	binary.LittleEndian.PutUint64(b[32:], uint64(h.created.UnixNano()))
+	binary.LittleEndian.PutUint32(b[44:], crc32.Checksum(b[:44], crcTable))
+	return b
+}
+
+// readHeader reads the header of the segment from br, leaving br at the first frame, and checks
+// that it is one this package can read. If the segment has no header, as is the case for segments
+// written before headers were introduced, nothing is read, and the zero segmentHeader is
+// returned.
+func (s segment) readHeader(br *bufio.Reader) (segmentHeader, error) {
+	magic, err := br.Peek(len(segmentMagic))
+	if err != nil && err != io.EOF {
+		return segmentHeader{}, err
+	}
+	if !bytes.Equal(magic, []byte(segmentMagic)) {
+		return segmentHeader{}, nil
+	}
+
+	b := make([]byte, segmentHeaderSize)
+	if _, err := io.ReadFull(br, b); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return segmentHeader{}, fmt.Errorf("data corruption: segment header is torn")
+	} else if err != nil {
+		return segmentHeader{}, err
+	}
+	if crc32.Checksum(b[:44], crcTable) != binary.LittleEndian.Uint32(b[44:]) {
+		return segmentHeader{}, fmt.Errorf("data corruption: invalid segment header checksum")
+	}
+	h := segmentHeader{
+		version:     binary.LittleEndian.Uint16(b[8:]),
+		checksum:    b[10],
+		compression: b[11],
+		seq:         binary.LittleEndian.Uint64(b[16:]),
+		ind:         binary.LittleEndian.Uint64(b[24:]),
+		created:     time.Unix(0, int64(binary.LittleEndian.Uint64(b[32:]))),
+	}
+	if h.version == 0 || h.version > segmentFormatVersion {
+		return segmentHeader{}, fmt.Errorf("unsupported segment format version: %d", h.version)
+	}
+	if h.checksum != checksumCRC32C {
+		return segmentHeader{}, fmt.Errorf("unsupported segment checksum algorithm: %d", h.checksum)
+	}
+	if h.compression != compressionNone {
+		return segmentHeader{}, fmt.Errorf("unsupported segment compression algorithm: %d", h.compression)
+	}
+	if h.seq != s.seq || h.ind != s.ind {
+		return segmentHeader{}, fmt.Errorf(
+			"data corruption: segment header is for seq %d and index %d, but the file is named for seq %d and index %d",
+			h.seq, h.ind, s.seq, s.ind)
+	}
+	return h, nil
+}
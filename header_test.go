@@ -0,0 +1,203 @@
+package wal
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rewriteFile replaces the contents of the named file with what f returns, given its contents.
+func rewriteFile(t *testing.T, fs FS, name string, f func([]byte) []byte) {
+	t.Helper()
+	r, err := fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := fs.OpenFile(name, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if _, err := w.Write(f(b)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Sync(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// segmentNames returns the names of every segment file of the WAL in dir.
+func segmentNames(t *testing.T, fs FS, dir string) []string {
+	t.Helper()
+	published, scratches, err := getSegmentPaths(fs, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(published, scratches...)
+}
+
+func Test_SegmentHeader(t *testing.T) {
+	fs := NewMemFS()
+	opts := &Options{SegmentSize: testSegmentSize, FS: fs}
+	start := time.Now()
+	wal, err := OpenWAL("wal", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	currInd := 0
+	for len(wal.pubSegs) < 2 {
+		if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every segment begins with a header that matches its name.
+	names := segmentNames(t, fs, "wal")
+	if len(names) != 3 {
+		t.Fatalf("expected 3 segments, but got %v", names)
+	}
+	for _, name := range names {
+		seq, ind, err := getSeqInd(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sr, err := segment{seq: seq, ind: ind, opts: &wal.opts}.openLimited(
+			filepath.Dir(name), testSegmentSize, wal.newPubReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := sr.header
+		sr.Close()
+		if h.version != segmentFormatVersion || h.checksum != checksumCRC32C ||
+			h.compression != compressionNone || h.seq != seq || h.ind != ind {
+			t.Fatalf("unexpected header for %s: %+v", name, h)
+		}
+		if h.created.Before(start) || h.created.After(time.Now()) {
+			t.Fatalf("expected %s to have been created just now, but it was created at %v", name, h.created)
+		}
+	}
+
+	// Headers that this package can't read are rejected, as are corrupt ones.
+	for _, tt := range []struct {
+		name   string
+		modify func(b []byte)
+		err    string
+	}{
+		{"future version", func(b []byte) { b[8] = segmentFormatVersion + 1 }, "unsupported segment format version"},
+		{"unknown checksum", func(b []byte) { b[10] = 0xff }, "unsupported segment checksum algorithm"},
+		{"unknown compression", func(b []byte) { b[11] = 0xff }, "unsupported segment compression algorithm"},
+		{"misnamed", func(b []byte) { b[16]++ }, "segment header is for seq"},
+		{"corrupt", func(b []byte) { b[44]++ }, "invalid segment header checksum"},
+		{"torn", nil, "segment header is torn"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := NewMemFS()
+			opts := &Options{SegmentSize: testSegmentSize, FS: fs}
+			wal, err := OpenWAL("wal", opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := wal.Write([]byte{42}); err != nil {
+				t.Fatal(err)
+			}
+			if err := wal.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			rewriteFile(t, fs, segmentNames(t, fs, "wal")[0], func(b []byte) []byte {
+				if tt.modify == nil {
+					return b[:segmentHeaderSize-1]
+				}
+				tt.modify(b)
+				if tt.name != "corrupt" {
+					binary.LittleEndian.PutUint32(b[44:], crc32.Checksum(b[:44], crcTable))
+				}
+				return b
+			})
+			if _, err := OpenWAL("wal", opts); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected an error about %q, but got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func Test_SegmentHeader_Legacy(t *testing.T) {
+	fs := NewMemFS()
+	opts := &Options{SegmentSize: testSegmentSize, FS: fs}
+	wal, err := OpenWAL("wal", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	currInd := 0
+	for len(wal.pubSegs) < 2 {
+		if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Strip every header and footer, as if the segments had been written before either was
+	// introduced.
+	published, scratches, err := getSegmentPaths(fs, "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range published {
+		rewriteFile(t, fs, name, func(b []byte) []byte {
+			return b[segmentHeaderSize:binary.LittleEndian.Uint64(b[len(b)-segmentFooterTailSize:])]
+		})
+	}
+	rewriteFile(t, fs, scratches[0], func(b []byte) []byte {
+		return b[segmentHeaderSize:]
+	})
+
+	// The records can still be read, and written to, across a reopen.
+	wal, err = OpenWAL("wal", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRecords(t, wal, 1, uint64(currInd))
+	if wal.scratchRW.header.version != 0 {
+		t.Fatalf("expected the scratch segment to be resumed without a header, but got %+v", wal.scratchRW.header)
+	}
+	if err := wal.TruncateBack(uint64(currInd - 1)); err != nil {
+		t.Fatal(err)
+	}
+	currInd--
+	pubSegs := len(wal.pubSegs)
+	for len(wal.pubSegs) < pubSegs+2 {
+		if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wal, err = OpenWAL("wal", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	expectRecords(t, wal, 1, uint64(currInd))
+	if wal.scratchRW.header.version != segmentFormatVersion {
+		t.Fatalf("expected new segments to have a header, but got %+v", wal.scratchRW.header)
+	}
+}
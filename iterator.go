@@ -0,0 +1,303 @@
+package wal
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"sync/atomic"
+)
+
+// Iterator reads records from a WAL in index order. It is created by WAL.ReadFrom or
+// WAL.ReadSyncedFrom.
+//
+// Each Iterator owns its own read buffer and file handles, so any number of them may be
+// open at the same time, concurrently with writes. An Iterator itself must not be used
+// concurrently.
+type Iterator struct {
+	wal *WAL
+	// synced restricts the iterator to records that have been synced to disk.
+	synced bool
+
+	// br is reused for every segment the iterator visits.
+	br   *bufio.Reader
+	segR *segmentReader
+
+	// seq is the seq of the segment currently being read (or to be read next).
+	seq uint64
+	// ind is the index of the next record that Next returns.
+	ind uint64
+	// seeking is true until the iterator has skipped forward to the index given to ReadFrom.
+	seeking bool
+	// last is the offset of the last frame read from segR, or -1 if there is none.
+	last int64
+
+	// truncations is the count of TruncateBacks of the WAL as of the last check (see
+	// checkTruncated), and truncated is set once they are found to have discarded records the
+	// iterator has returned.
+	truncations uint64
+	truncated   bool
+}
+
+// Next returns the next record and its index. io.EOF is returned once every available
+// record has been read.
+//
+// If records the iterator has returned are discarded by TruncateBack, it returns ErrTruncated from
+// the moment it notices, which is at the latest once it runs out of records to read. ReadFrom the
+// index following the truncation point to read on.
+func (it *Iterator) Next() (uint64, []byte, error) {
+	rec, err := it.NextRecord()
+	return rec.Index, rec.Data, err
+}
+
+// NextRecord is like Next, but returns the record along with its metadata.
+func (it *Iterator) NextRecord() (Record, error) {
+	for {
+		if it.segR == nil {
+			if err := it.open(); err != nil {
+				return Record{}, err
+			}
+		}
+		if it.segR.lr != nil && atomic.LoadUint64(&it.wal.truncations) != it.truncations {
+			// Frames read ahead of time from the scratch segment may have been discarded since.
+			if _, err := it.checkTruncated(); err != nil {
+				return Record{}, err
+			}
+		}
+		offset, crc := it.segR.deframer.nBytes, it.segR.deframer.crc
+		data, _, err := it.segR.deframe()
+		if err != nil && err != io.EOF {
+			// The frame may have been discarded by TruncateBack since it was read ahead. If so,
+			// read it again, unless the records before it have been discarded as well.
+			it.segR.deframer.nBytes, it.segR.deframer.crc = offset, crc
+			truncated, truncErr := it.checkTruncated()
+			if truncErr != nil {
+				return Record{}, truncErr
+			}
+			if truncated && it.segR.lr != nil {
+				continue
+			}
+			return Record{}, err
+		}
+		if err == io.EOF && it.segR.lr != nil {
+			// reached the end of what the writer has made visible so far
+			more, err := it.extend()
+			if err != nil {
+				return Record{}, err
+			}
+			if more {
+				continue
+			}
+			return Record{}, io.EOF
+		}
+		if err == io.EOF {
+			if err := it.closeSegment(); err != nil {
+				return Record{}, err
+			}
+			it.seq++
+			continue
+		}
+		if err != nil {
+			return Record{}, err
+		}
+		rec, err := decodeRecord(it.ind, it.segR.deframer.flags, data)
+		if err != nil {
+			return Record{}, err
+		}
+		it.ind++
+		it.last = int64(offset)
+		return rec, nil
+	}
+}
+
+// NextWait is like Next, except that once every available record has been read, it waits for the
+// next one to be written (or synced, for an Iterator created by ReadSyncedFrom) rather than
+// returning io.EOF. It returns ctx.Err() if ctx is done first, and ErrClosed if the WAL is
+// closed.
+//
+// Writes through the same WAL wake it up right away. A WAL opened with OpenReadOnly is instead
+// polled every Options.PollInterval for records written by another process. Either way, segments
+// that are cut off in the meantime are followed into the next one, and records discarded by
+// TruncateBack are reported as by Next.
+func (it *Iterator) NextWait(ctx context.Context) (uint64, []byte, error) {
+	rec, err := it.NextRecordWait(ctx)
+	return rec.Index, rec.Data, err
+}
+
+// NextRecordWait is like NextWait, but returns the record along with its metadata.
+func (it *Iterator) NextRecordWait(ctx context.Context) (Record, error) {
+	for {
+		// get notified of records written from here on, so that none slip by after NextRecord
+		notifyC := it.wal.notifyChan()
+		rec, err := it.NextRecord()
+		if err != io.EOF {
+			return rec, err
+		}
+		if err := it.wal.wait(ctx, notifyC); err != nil {
+			return Record{}, err
+		}
+	}
+}
+
+// Close releases the resources held by the iterator.
+func (it *Iterator) Close() error {
+	return it.closeSegment()
+}
+
+// open opens the segment the next record lives in and skips forward to that record.
+func (it *Iterator) open() error {
+	for {
+		it.last = -1
+		segR, err := it.wal.openSegment(it.seq, it.synced, it.reuseReader)
+		if err != nil {
+			return err
+		}
+
+		if !it.seeking {
+			// subsequent segments are read from their first record
+			it.ind = segR.segment.ind
+			it.segR = segR
+			return nil
+		}
+
+		if segR.footer != nil {
+			// look up it.ind in the footer, if it lies in this segment at all
+			if it.ind > segR.footer.lastInd {
+				segR.Close()
+				it.seq++
+				continue
+			}
+			if err := segR.seek(it.ind); err != nil {
+				segR.Close()
+				return err
+			}
+			it.seeking = false
+			it.segR = segR
+			return nil
+		}
+		if segR.lr != nil {
+			// look up it.ind in the index of the scratch segment, unless it has been published
+			// since
+			if offset, prev, ok := it.wal.scratchOffset(segR.segment.seq, it.ind); ok {
+				if offset >= segR.lr.limit {
+					// it.ind has not been written (or made visible) yet
+					segR.Close()
+					return io.EOF
+				}
+				if segR.lr, err = segR.seekTo(offset, prev, segR.lr.limit); err != nil {
+					segR.Close()
+					return err
+				}
+				it.last = prev
+				it.seeking = false
+				it.segR = segR
+				return nil
+			}
+		}
+
+		// skip records preceding it.ind
+		for ind := segR.segment.ind; ind < it.ind; ind++ {
+			offset := segR.deframer.nBytes
+			if _, _, err = segR.deframe(); err != nil {
+				break
+			}
+			it.last = int64(offset)
+		}
+		if err == io.EOF {
+			segR.Close()
+			if segR.lr != nil {
+				// it.ind has not been written (or made visible) yet
+				return io.EOF
+			}
+			// it.ind lies beyond this segment
+			it.seq++
+			continue
+		}
+		if err != nil {
+			segR.Close()
+			return err
+		}
+		it.seeking = false
+		it.segR = segR
+		return nil
+	}
+}
+
+// extend raises the read limit of the scratch segment being read, if the writer has made more of
+// it visible since. It reports whether there may be more frames to read.
+func (it *Iterator) extend() (bool, error) {
+	if _, err := it.checkTruncated(); err != nil {
+		return false, err
+	}
+	lr := it.segR.lr
+	limit, published, err := it.wal.readLimit(it.seq, it.synced)
+	if err != nil {
+		return false, err
+	}
+	if published {
+		// the segment can now be read through to the end of its frames
+		if lr.limit, err = it.segR.framesEnd(); err != nil {
+			return false, err
+		}
+		it.segR.lr = nil
+		return true, nil
+	}
+	if limit <= lr.limit {
+		return false, nil
+	}
+	lr.limit = limit
+	return true, nil
+}
+
+// checkTruncated checks whether TruncateBack has discarded records since the last check, and
+// reports so. If the records include ones the iterator has returned, ErrTruncated is returned.
+// Otherwise, the iterator may read on, but only as far as the WAL makes visible anew: what was
+// visible past the last frame read may be gone.
+func (it *Iterator) checkTruncated() (bool, error) {
+	if it.truncated {
+		return true, ErrTruncated
+	}
+	truncations, lastInd := it.wal.truncatedBack()
+	if truncations == it.truncations {
+		return false, nil
+	}
+	if !it.seeking && it.ind-1 > lastInd {
+		it.truncated = true
+		return true, ErrTruncated
+	}
+	if segR := it.segR; segR != nil && segR.lr != nil {
+		// The scratch segment may have been truncated and written to anew within what was read.
+		if it.last >= 0 {
+			intact, err := segR.frameIntact(it.last)
+			if err != nil {
+				return true, err
+			}
+			if !intact {
+				it.truncated = true
+				return true, ErrTruncated
+			}
+		} else if err := segR.reposition(); err != nil {
+			return true, err
+		}
+		segR.lr.limit = int64(segR.deframer.nBytes)
+	}
+	it.truncations = truncations
+	return true, nil
+}
+
+func (it *Iterator) closeSegment() error {
+	if it.segR == nil {
+		return nil
+	}
+	err := it.segR.Close()
+	it.segR = nil
+	return err
+}
+
+func (it *Iterator) reuseReader(r io.Reader) *bufio.Reader {
+	if it.br == nil {
+		it.br = bufio.NewReaderSize(r, it.wal.opts.ReadBufferSize)
+	} else {
+		it.br.Reset(r)
+	}
+	return it.br
+}
@@ -0,0 +1,522 @@
+package wal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func Test_WAL_ReadFrom(t *testing.T) {
+	currInd := 0
+
+	// Create a new WAL.
+	baseDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(baseDir)
+	walDir := filepath.Join(baseDir, "wal")
+	wal, err := OpenWAL(walDir, &Options{SegmentSize: testSegmentSize, Logger: zap.NewExample()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	// Publish a few segments.
+	for len(wal.pubSegs) < 3 {
+		if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first, last := wal.FirstIndex(), wal.LastIndex()
+
+	for start := first; start <= last+1; start++ {
+		it, err := wal.ReadFrom(start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := start
+		for {
+			ind, data, err := it.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := strconv.Atoi(string(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ind != want || uint64(got) != want-first {
+				t.Fatalf("reading from %d: expected record %d, but got record %d at index %d", start, want-first, got, ind)
+			}
+			want++
+		}
+		if want != last+1 {
+			t.Fatalf("reading from %d: stopped at %d, but expected to stop at %d", start, want, last+1)
+		}
+		if err := it.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Test_WAL_ReadFrom_ConcurrentIterators(t *testing.T) {
+	currInd := 0
+
+	// Create a new WAL.
+	baseDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(baseDir)
+	walDir := filepath.Join(baseDir, "wal")
+	wal, err := OpenWAL(walDir, &Options{SegmentSize: testSegmentSize, Logger: zap.NewExample()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	for len(wal.pubSegs) < 2 {
+		if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Interleave two iterators over the same segments.
+	it1, err := wal.ReadFrom(wal.FirstIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it1.Close()
+	it2, err := wal.ReadFrom(wal.FirstIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it2.Close()
+	for i := 0; i < int(wal.LastIndex()); i++ {
+		for _, it := range []*Iterator{it1, it2} {
+			_, data, err := it.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := fmt.Sprintf("%d", i); string(data) != want {
+				t.Fatalf("expected %s, but got %s", want, data)
+			}
+		}
+	}
+}
+
+func Test_WAL_ReadFrom_Scratch(t *testing.T) {
+	currInd := 0
+
+	// Create a new WAL.
+	baseDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(baseDir)
+	walDir := filepath.Join(baseDir, "wal")
+	wal, err := OpenWAL(walDir, &Options{SegmentSize: testSegmentSize, Logger: zap.NewExample()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	// Sync one record, but leave the next one buffered.
+	if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := wal.ReadFrom(wal.FirstIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer all.Close()
+	synced, err := wal.ReadSyncedFrom(wal.FirstIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer synced.Close()
+
+	expectNext := func(it *Iterator, want int) {
+		t.Helper()
+		_, data, err := it.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != strconv.Itoa(want) {
+			t.Fatalf("expected %d, but got %s", want, data)
+		}
+	}
+	expectEOF := func(it *Iterator) {
+		t.Helper()
+		if _, data, err := it.Next(); err != io.EOF {
+			t.Fatalf("expected io.EOF, but got %s, %v", data, err)
+		}
+	}
+
+	expectNext(all, 0)
+	expectNext(all, 1)
+	expectEOF(all)
+	expectNext(synced, 0)
+	expectEOF(synced)
+
+	// Writes (and syncs) after reaching the end become visible to the same iterators, even
+	// after the scratch segment gets published.
+	for len(wal.pubSegs) == 0 {
+		if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 2; i < currInd; i++ {
+		expectNext(all, i)
+	}
+	expectEOF(all)
+
+	if err := wal.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < currInd; i++ {
+		expectNext(synced, i)
+	}
+	expectEOF(synced)
+}
+
+func Test_WAL_ConcurrentReadersAndWriter(t *testing.T) {
+	const (
+		nRecords = 300
+		nReaders = 4
+	)
+
+	// Create a new WAL.
+	baseDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(baseDir)
+	walDir := filepath.Join(baseDir, "wal")
+	wal, err := OpenWAL(walDir, &Options{SegmentSize: testSegmentSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	var wg sync.WaitGroup
+	errC := make(chan error, nReaders+1)
+
+	// One writer...
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= nRecords; i++ {
+			if _, err := wal.Append([]byte(strconv.Itoa(i))); err != nil {
+				errC <- err
+				return
+			}
+			if i%10 == 0 {
+				if err := wal.Sync(); err != nil {
+					errC <- err
+					return
+				}
+			}
+		}
+	}()
+
+	// ...and many readers, each following the WAL until it has read every record.
+	for r := 0; r < nReaders; r++ {
+		wg.Add(1)
+		go func(synced bool) {
+			defer wg.Done()
+			var it *Iterator
+			var err error
+			if synced {
+				it, err = wal.ReadSyncedFrom(1)
+			} else {
+				it, err = wal.ReadFrom(1)
+			}
+			if err != nil {
+				errC <- err
+				return
+			}
+			defer it.Close()
+			for want := uint64(1); want <= nRecords; {
+				ind, data, err := it.Next()
+				if err == io.EOF {
+					runtime.Gosched()
+					continue
+				}
+				if err != nil {
+					errC <- err
+					return
+				}
+				if ind != want || string(data) != strconv.Itoa(int(want)) {
+					errC <- fmt.Errorf("expected record %d, but got %s at index %d", want, data, ind)
+					return
+				}
+				want++
+			}
+		}(r%2 == 0)
+	}
+
+	wg.Wait()
+	close(errC)
+	for err := range errC {
+		t.Fatal(err)
+	}
+}
+
+func Test_Iterator_NextWait(t *testing.T) {
+	const nRecords = 100
+
+	// follow reads records [from, to] through NextWait.
+	follow := func(t *testing.T, it *Iterator, from, to uint64) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		for want := from; want <= to; want++ {
+			ind, data, err := it.NextWait(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ind != want || string(data) != strconv.Itoa(int(want)) {
+				t.Fatalf("expected record %d, but got %s at index %d", want, data, ind)
+			}
+		}
+	}
+	// write appends records [1, nRecords], across a few cuts.
+	write := func(wal *WAL) <-chan error {
+		errC := make(chan error, 1)
+		go func() {
+			for i := 1; i <= nRecords; i++ {
+				if _, err := wal.Append([]byte(strconv.Itoa(i))); err != nil {
+					errC <- err
+					return
+				}
+			}
+			errC <- nil
+		}()
+		return errC
+	}
+
+	t.Run("in-process", func(t *testing.T) {
+		wal, err := OpenWAL("wal", &Options{SegmentSize: testSegmentSize, FS: NewMemFS()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer wal.Close()
+		all, err := wal.ReadFrom(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer all.Close()
+		synced, err := wal.ReadSyncedFrom(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer synced.Close()
+
+		// Iterators can start following from records that haven't been written yet.
+		later, err := wal.ReadFrom(nRecords / 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer later.Close()
+
+		errC := write(wal)
+		follow(t, all, 1, nRecords)
+		follow(t, later, nRecords/2, nRecords)
+		if err := <-errC; err != nil {
+			t.Fatal(err)
+		}
+		if _, err := wal.Append([]byte(strconv.Itoa(nRecords + 1))); err != nil {
+			t.Fatal(err)
+		}
+
+		// Synced iterators wait for the records to be synced (which cutting does too).
+		var last uint64
+		for {
+			ind, _, err := synced.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			last = ind
+		}
+		if last == 0 || last > nRecords {
+			t.Fatalf("expected some records to be synced, but not all, but got up to %d", last)
+		}
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			wal.Sync()
+		}()
+		follow(t, synced, last+1, nRecords+1)
+
+		// Waiting ends once the context is done, or the WAL is closed.
+		follow(t, all, nRecords+1, nRecords+1)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, _, err := all.NextWait(ctx); err != context.Canceled {
+			t.Fatalf("expected context.Canceled, but got %v", err)
+		}
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			wal.Close()
+		}()
+		if _, _, err := all.NextWait(context.Background()); err != ErrClosed {
+			t.Fatalf("expected ErrClosed, but got %v", err)
+		}
+	})
+
+	t.Run("read-only", func(t *testing.T) {
+		fs := NewMemFS()
+		wal, err := OpenWAL("wal", &Options{SegmentSize: testSegmentSize, FS: fs, SyncPolicy: SyncAlways})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer wal.Close()
+
+		// The read-only WAL sees nothing of what the writer does, other than through the FS.
+		ro, err := OpenReadOnly("wal", &Options{FS: fs, PollInterval: time.Millisecond})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ro.Close()
+		it, err := ro.ReadFrom(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer it.Close()
+
+		errC := write(wal)
+		follow(t, it, 1, nRecords)
+		if err := <-errC; err != nil {
+			t.Fatal(err)
+		}
+		if len(wal.pubSegs) < 3 {
+			t.Fatalf("expected the writer to cut a few segments, but it only cut %d", len(wal.pubSegs))
+		}
+		if ro.LastIndex() != nRecords {
+			t.Fatalf("expected last index %d, but got %d", nRecords, ro.LastIndex())
+		}
+	})
+}
+
+func Test_Iterator_TruncateBack(t *testing.T) {
+	// truncate appends records 1 to 5 through writer, then discards 4 and 5 with TruncateBack and
+	// appends "d" to "g" in their place, all within the scratch segment. Iterators of wal read
+	// through next.
+	truncate := func(t *testing.T, writer, wal *WAL, next func(*Iterator) (uint64, []byte, error)) {
+		t.Helper()
+		expect := func(it *Iterator, ind uint64, want string) {
+			t.Helper()
+			if got, data, err := next(it); err != nil {
+				t.Fatal(err)
+			} else if got != ind || string(data) != want {
+				t.Fatalf("expected record %d to be %q, but got %q at index %d", ind, want, data, got)
+			}
+		}
+		for i := 1; i <= 5; i++ {
+			if _, err := writer.Append([]byte(strconv.Itoa(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writer.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		ahead, err := wal.ReadFrom(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ahead.Close()
+		behind, err := wal.ReadFrom(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer behind.Close()
+		for ind := uint64(1); ind <= 5; ind++ {
+			expect(ahead, ind, strconv.Itoa(int(ind)))
+		}
+		for ind := uint64(1); ind <= 3; ind++ {
+			expect(behind, ind, strconv.Itoa(int(ind)))
+		}
+
+		if err := writer.TruncateBack(3); err != nil {
+			t.Fatal(err)
+		}
+		for _, data := range []string{"d", "e", "f", "g"} {
+			if _, err := writer.Append([]byte(data)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writer.Sync(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The iterator that has returned discarded records can't read on, but the one that hasn't
+		// reads the records written in their place, as does a new one.
+		for i := 0; i < 2; i++ {
+			if _, _, err := next(ahead); err != ErrTruncated {
+				t.Fatalf("expected ErrTruncated, but got %v", err)
+			}
+		}
+		for i, data := range []string{"d", "e", "f", "g"} {
+			expect(behind, uint64(4+i), data)
+		}
+		it, err := wal.ReadFrom(4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer it.Close()
+		expect(it, 4, "d")
+	}
+
+	t.Run("in-process", func(t *testing.T) {
+		wal, err := OpenWAL("wal", &Options{SegmentSize: 4096, FS: NewMemFS()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer wal.Close()
+		truncate(t, wal, wal, (*Iterator).Next)
+	})
+
+	t.Run("read-only", func(t *testing.T) {
+		fs := NewMemFS()
+		wal, err := OpenWAL("wal", &Options{SegmentSize: 4096, FS: fs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer wal.Close()
+		ro, err := OpenReadOnly("wal", &Options{FS: fs, PollInterval: time.Millisecond})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ro.Close()
+		truncate(t, wal, ro, func(it *Iterator) (uint64, []byte, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			return it.NextWait(ctx)
+		})
+	})
+}
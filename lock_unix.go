@@ -3,21 +3,49 @@
 package wal
 
 import (
-	"fmt"
+	"io"
 	"os"
 	"syscall"
 )
 
-var (
-	errLocked = fmt.Errorf("file already locked")
-)
-
 // lockFileNonBlocking locks the file via the Flock system call. It is performed
 // in non-blocking mode, so if it is locked, it immediately returns with syscall.EWOULDBLOCK.
 func lockFileNonBlocking(f *os.File) error {
-	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	return flockNonBlocking(f, syscall.LOCK_EX)
+}
+
+// rlockFileNonBlocking is like lockFileNonBlocking, but takes a shared lock.
+func rlockFileNonBlocking(f *os.File) error {
+	return flockNonBlocking(f, syscall.LOCK_SH)
+}
+
+func flockNonBlocking(f *os.File, how int) error {
+	err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
 	if err == syscall.EWOULDBLOCK {
-		err = errLocked
+		err = ErrLocked
 	}
 	return err
 }
+
+// Lock implements FS for osFS. The lock is a Flock on a separate file descriptor, so it conflicts
+// with other locks on the file, even within the same process.
+func (osFS) Lock(name string) (io.Closer, error) {
+	return lockFile(name, lockFileNonBlocking)
+}
+
+// RLock implements FS for osFS, like Lock.
+func (osFS) RLock(name string) (io.Closer, error) {
+	return lockFile(name, rlockFileNonBlocking)
+}
+
+func lockFile(name string, lock func(*os.File) error) (io.Closer, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := lock(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
@@ -33,7 +33,7 @@ func TestLockAndUnlock(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err = lockFileNonBlocking(f2); err != errLocked {
+	if err = lockFileNonBlocking(f2); err != ErrLocked {
 		t.Fatal(err)
 	}
 
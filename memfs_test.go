@@ -0,0 +1,259 @@
+package wal
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func Test_MemFS_WAL(t *testing.T) {
+	currInd := 0
+	fs := NewMemFS()
+	opts := &Options{SegmentSize: testSegmentSize, FS: fs, Logger: zap.NewExample()}
+	wal, err := OpenWAL("wal", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Write across a couple of cuts, with a reader following along.
+	it, err := wal.ReadFrom(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(wal.pubSegs) < 2 {
+		if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+			t.Fatal(err)
+		}
+		ind, data, err := it.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int(ind) != currInd || string(data) != fmt.Sprintf("%d", currInd-1) {
+			t.Fatalf("expected record %d, but got %d: %s", currInd, ind, data)
+		}
+	}
+	it.Close()
+	n, err := wal.Write(numAndInc(&currInd))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The WAL is locked for as long as it is open.
+	if _, err := OpenWAL("wal", opts); err != ErrLocked {
+		t.Fatalf("expected ErrLocked, but got %v", err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing should have touched the disk.
+	if _, err := os.Stat("wal"); !os.IsNotExist(err) {
+		t.Fatalf("expected the WAL to not exist on disk, but got %v", err)
+	}
+
+	// Tear off the end of the last record, then recover.
+	_, scratch, err := findSegments("wal", &wal.opts, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.OpenFile(segmentFileName(scratchDir(scratch.dir), scratch.seq, scratch.ind), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(int64(segmentHeaderSize + n - 1)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	wal, err = OpenWAL("wal", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	currInd--
+	if wal.LastIndex() != uint64(currInd) {
+		t.Fatalf("expected last index %d, but got %d", currInd, wal.LastIndex())
+	}
+
+	// Truncate both ends, and visit what is left.
+	if err := wal.TruncateFront(wal.pubSegs[1].ind); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.TruncateBack(wal.LastIndex() - 1); err != nil {
+		t.Fatal(err)
+	}
+	i := int(wal.FirstIndex()) - 1
+	if err := wal.Visit(func(data []byte) error {
+		if string(data) != fmt.Sprintf("%d", i) {
+			return fmt.Errorf("expected %d, but got %s", i, data)
+		}
+		i++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if i != currInd-1 {
+		t.Fatalf("visited up to %d, but expected up to %d", i, currInd-1)
+	}
+}
+
+func Test_MemFS(t *testing.T) {
+	fs := NewMemFS()
+	if err := fs.Mkdir("a/b", privateDirMode); !os.IsNotExist(err) {
+		t.Fatalf("expected a not-exist error, but got %v", err)
+	}
+	if err := fs.MkdirAll("a/b", privateDirMode); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files keep their contents across opens, and can be read back in pieces.
+	f, err := fs.OpenFile("a/b/c", os.O_WRONLY|os.O_CREATE|os.O_EXCL, privateFileMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("j"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Preallocate(8); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := f.Write([]byte("!")); err == nil {
+		t.Fatal("expected writing to a closed file to fail")
+	}
+	f, err = fs.OpenFile("a/b/c", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b [3]byte
+	var got []byte
+	for {
+		n, err := f.Read(b[:])
+		got = append(got, b[:n]...)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if string(got) != "jello\x00\x00\x00" {
+		t.Fatalf("expected jello followed by zeros, but got %q", got)
+	}
+	if _, err := f.Write([]byte("!")); err == nil {
+		t.Fatal("expected writing to a read-only file to fail")
+	}
+
+	// The open file keeps working across a rename.
+	if err := fs.Rename("a/b/c", "a/d"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(1, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Read(b[:]); err != nil || string(b[:]) != "ell" {
+		t.Fatalf("expected ell, but got %q (%v)", b, err)
+	}
+	f.Close()
+	if names, err := fs.List("a"); err != nil || len(names) != 2 || names[0] != "b" || names[1] != "d" {
+		t.Fatalf("expected [b d], but got %v (%v)", names, err)
+	}
+	if fi, err := fs.Stat("a/d"); err != nil || fi.Size() != 8 || fi.IsDir() {
+		t.Fatalf("expected an 8 byte file, but got %+v (%v)", fi, err)
+	}
+	if err := fs.Remove("a"); err == nil {
+		t.Fatal("expected removing a non-empty directory to fail")
+	}
+	if err := fs.Remove("a/d"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("a/d"); !os.IsNotExist(err) {
+		t.Fatalf("expected a not-exist error, but got %v", err)
+	}
+}
+
+func Test_MemFS_Crash(t *testing.T) {
+	fs := NewMemFS()
+	write := func(name, data string, sync bool) {
+		t.Helper()
+		f, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, privateFileMode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		if sync {
+			if err := f.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	read := func(name string) string {
+		t.Helper()
+		f, err := fs.OpenFile(name, os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		var b [64]byte
+		n, _ := f.Read(b[:])
+		return string(b[:n])
+	}
+
+	if err := fs.Mkdir("d", privateDirMode); err != nil {
+		t.Fatal(err)
+	}
+	write("d/synced", "a", true)
+	write("d/unsynced", "b", false)
+	if err := fs.SyncDir("."); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SyncDir("d"); err != nil {
+		t.Fatal(err)
+	}
+	write("d/synced", "c", false)
+	write("d/new", "d", true)
+	if err := fs.Rename("d/unsynced", "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.OpenFile("d/synced", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Lock("d/synced"); err != nil {
+		t.Fatal(err)
+	}
+
+	fs.Crash(nil)
+
+	// Unsynced data and directory entries are gone, and the rename is undone.
+	if names, err := fs.List("d"); err != nil || len(names) != 2 || names[0] != "synced" || names[1] != "unsynced" {
+		t.Fatalf("expected [synced unsynced], but got %v (%v)", names, err)
+	}
+	if _, err := fs.Stat("renamed"); !os.IsNotExist(err) {
+		t.Fatalf("expected a not-exist error, but got %v", err)
+	}
+	if got := read("d/synced"); got != "a" {
+		t.Fatalf("expected a, but got %q", got)
+	}
+	if got := read("d/unsynced"); got != "" {
+		t.Fatalf("expected nothing, but got %q", got)
+	}
+
+	// Files and locks from before the crash are gone as well.
+	var b [1]byte
+	if _, err := f.Read(b[:]); err == nil {
+		t.Fatal("expected reading a file opened before the crash to fail")
+	}
+	l, err := fs.Lock("d/synced")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+}
@@ -0,0 +1,154 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultReadBufferSize is the default size of the buffer each reader reads segments through.
+	DefaultReadBufferSize = 64 * 1024
+
+	// DefaultWriteBufferSize is the default size of the buffer frames are written through.
+	DefaultWriteBufferSize = 64 * 1024
+
+	// DefaultPollInterval is the default interval at which a read-only WAL is polled for new
+	// records.
+	DefaultPollInterval = 100 * time.Millisecond
+
+	// DefaultReadCacheSize is the default number of records that WAL.Read and WAL.ReadRange keep
+	// in memory.
+	DefaultReadCacheSize = 1024
+)
+
+// SyncPolicy decides when the WAL syncs writes to disk on its own. Regardless of the policy,
+// Sync may be called at any time.
+type SyncPolicy int
+
+const (
+	// SyncNever never syncs on its own, leaving it up to the caller (and the OS, which
+	// eventually writes dirty pages back to disk).
+	SyncNever SyncPolicy = iota
+
+	// SyncAlways syncs after every write.
+	SyncAlways
+
+	// SyncEveryN syncs after every Options.SyncBatchSize records written.
+	SyncEveryN
+
+	// SyncInterval syncs every Options.SyncInterval, if anything has been written since the
+	// last sync.
+	SyncInterval
+)
+
+// Options configures a WAL. A nil *Options is equivalent to the zero Options, and zero fields
+// take on their default values.
+type Options struct {
+	// SegmentSize is the size (in bytes) at which a segment is cut off and published, and the
+	// size that segment files are preallocated to. Defaults to SegmentSizeBytes.
+	SegmentSize int
+
+	// ReadBufferSize is the size of the buffer each reader reads segments through. Defaults to
+	// DefaultReadBufferSize.
+	ReadBufferSize int
+
+	// WriteBufferSize is the size of the buffer frames are written through. Defaults to
+	// DefaultWriteBufferSize.
+	WriteBufferSize int
+
+	// FileMode is the permission bits of the files the WAL creates. Defaults to 0600.
+	FileMode os.FileMode
+
+	// DirMode is the permission bits of the directories the WAL creates. Defaults to 0700.
+	DirMode os.FileMode
+
+	// NoPreallocate disables preallocating the space of segment files when they are created.
+	NoPreallocate bool
+
+	// FS is the filesystem that the WAL keeps its files in. Defaults to OS.
+	FS FS
+
+	// Logger logs notable events, if set.
+	Logger *zap.Logger
+
+	// SyncPolicy decides when the WAL syncs writes to disk on its own. Unless it is SyncNever,
+	// Close syncs as well, so that the last writes are not lost.
+	SyncPolicy SyncPolicy
+
+	// SyncBatchSize is the number of records written between syncs, for SyncEveryN.
+	SyncBatchSize int
+
+	// SyncInterval is the time between syncs, for SyncInterval.
+	SyncInterval time.Duration
+
+	// PollInterval is how often Iterator.NextWait checks a WAL opened with OpenReadOnly for
+	// records written since (by another process, say). Defaults to DefaultPollInterval.
+	PollInterval time.Duration
+
+	// ReadCacheSize is the number of records most recently read by WAL.Read and WAL.ReadRange
+	// that are kept in memory. Defaults to DefaultReadCacheSize.
+	ReadCacheSize int
+}
+
+// withDefaults returns a copy of the options, where zero fields take on their default values.
+func (opts *Options) withDefaults() Options {
+	o := *opts
+	if o.SegmentSize == 0 {
+		o.SegmentSize = SegmentSizeBytes
+	}
+	if o.ReadBufferSize == 0 {
+		o.ReadBufferSize = DefaultReadBufferSize
+	}
+	if o.WriteBufferSize == 0 {
+		o.WriteBufferSize = DefaultWriteBufferSize
+	}
+	if o.FileMode == 0 {
+		o.FileMode = privateFileMode
+	}
+	if o.DirMode == 0 {
+		o.DirMode = privateDirMode
+	}
+	if o.FS == nil {
+		o.FS = OS
+	}
+	if o.PollInterval == 0 {
+		o.PollInterval = DefaultPollInterval
+	}
+	if o.ReadCacheSize == 0 {
+		o.ReadCacheSize = DefaultReadCacheSize
+	}
+	return o
+}
+
+func (opts *Options) validate() error {
+	if opts.SegmentSize < 0 {
+		return fmt.Errorf("SegmentSize must not be negative: got %d", opts.SegmentSize)
+	}
+	if opts.ReadBufferSize < 0 || opts.WriteBufferSize < 0 {
+		return fmt.Errorf("buffer sizes must not be negative: got %d and %d",
+			opts.ReadBufferSize, opts.WriteBufferSize)
+	}
+	if opts.PollInterval < 0 {
+		return fmt.Errorf("PollInterval must not be negative: got %v", opts.PollInterval)
+	}
+	if opts.ReadCacheSize < 0 {
+		return fmt.Errorf("ReadCacheSize must not be negative: got %d", opts.ReadCacheSize)
+	}
+	switch opts.SyncPolicy {
+	case SyncNever, SyncAlways:
+	case SyncEveryN:
+		if opts.SyncBatchSize <= 0 {
+			return fmt.Errorf("SyncBatchSize must be positive for SyncEveryN: got %d", opts.SyncBatchSize)
+		}
+	case SyncInterval:
+		if opts.SyncInterval <= 0 {
+			return fmt.Errorf("SyncInterval must be positive for SyncInterval: got %v", opts.SyncInterval)
+		}
+	default:
+		return fmt.Errorf("unknown SyncPolicy: %d", opts.SyncPolicy)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package wal
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func Test_Options_SyncPolicy(t *testing.T) {
+	// countSynced counts the records that have been synced.
+	countSynced := func(t *testing.T, wal *WAL) int {
+		t.Helper()
+		it, err := wal.ReadSyncedFrom(wal.FirstIndex())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer it.Close()
+		n := 0
+		for {
+			_, _, err := it.Next()
+			if err == io.EOF {
+				return n
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			n++
+		}
+	}
+	openWAL := func(t *testing.T, opts *Options) (*WAL, func()) {
+		t.Helper()
+		baseDir, err := ioutil.TempDir("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opts == nil {
+			opts = &Options{}
+		}
+		// room for every record, so that no cut syncs any of them
+		opts.SegmentSize = 4 * testSegmentSize
+		opts.Logger = zap.NewExample()
+		wal, err := OpenWAL(filepath.Join(baseDir, "wal"), opts)
+		if err != nil {
+			os.RemoveAll(baseDir)
+			t.Fatal(err)
+		}
+		return wal, func() {
+			wal.Close()
+			os.RemoveAll(baseDir)
+		}
+	}
+
+	t.Run("SyncNever", func(t *testing.T) {
+		wal, cleanup := openWAL(t, nil)
+		defer cleanup()
+		if _, err := wal.Append([]byte{1}); err != nil {
+			t.Fatal(err)
+		}
+		if n := countSynced(t, wal); n != 0 {
+			t.Fatalf("expected no records to be synced, but %d were", n)
+		}
+	})
+
+	t.Run("SyncAlways", func(t *testing.T) {
+		wal, cleanup := openWAL(t, &Options{SyncPolicy: SyncAlways})
+		defer cleanup()
+		for i := 1; i <= 3; i++ {
+			if _, err := wal.Append([]byte{byte(i)}); err != nil {
+				t.Fatal(err)
+			}
+			if n := countSynced(t, wal); n != i {
+				t.Fatalf("expected %d records to be synced, but %d were", i, n)
+			}
+		}
+	})
+
+	t.Run("SyncEveryN", func(t *testing.T) {
+		wal, cleanup := openWAL(t, &Options{SyncPolicy: SyncEveryN, SyncBatchSize: 3})
+		defer cleanup()
+		for i := 1; i <= 2; i++ {
+			if _, err := wal.Append([]byte{byte(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if n := countSynced(t, wal); n != 0 {
+			t.Fatalf("expected no records to be synced, but %d were", n)
+		}
+		var b Batch
+		b.Add([]byte{3})
+		b.Add([]byte{4})
+		if _, err := wal.WriteBatch(&b); err != nil {
+			t.Fatal(err)
+		}
+		if n := countSynced(t, wal); n != 4 {
+			t.Fatalf("expected 4 records to be synced, but %d were", n)
+		}
+	})
+
+	t.Run("SyncInterval", func(t *testing.T) {
+		wal, cleanup := openWAL(t, &Options{SyncPolicy: SyncInterval, SyncInterval: 10 * time.Millisecond})
+		defer cleanup()
+		if _, err := wal.Append([]byte{1}); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for countSynced(t, wal) != 1 {
+			if time.Now().After(deadline) {
+				t.Fatal("record was never synced")
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		// Close syncs the last interval.
+		if _, err := wal.Append([]byte{2}); err != nil {
+			t.Fatal(err)
+		}
+		if err := wal.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if wal.unsynced != 0 || wal.scratchRW.synced != wal.scratchRW.flushed {
+			t.Fatalf("expected Close to sync, but %d records were left unsynced", wal.unsynced)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, opts := range []*Options{
+			{SyncPolicy: SyncEveryN},
+			{SyncPolicy: SyncInterval},
+			{SyncPolicy: -1},
+			{SegmentSize: -1},
+			{ReadBufferSize: -1},
+			{WriteBufferSize: -1},
+		} {
+			if _, err := OpenWAL("", opts); err == nil {
+				t.Fatalf("expected %+v to be rejected", opts)
+			}
+		}
+	})
+}
+
+func Test_Options_Files(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(baseDir)
+	walDir := filepath.Join(baseDir, "wal")
+	opts := &Options{
+		SegmentSize:     testSegmentSize,
+		ReadBufferSize:  16,
+		WriteBufferSize: 16,
+		FileMode:        0640,
+		DirMode:         0750,
+		NoPreallocate:   true,
+	}
+	wal, err := OpenWAL(walDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	// Buffers smaller than a frame shouldn't get in the way of writing or reading.
+	currInd := 0
+	for len(wal.pubSegs) < 2 {
+		if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	i := 0
+	if err := wal.Visit(func(data []byte) error {
+		if string(data) != fmt.Sprintf("%d", i) {
+			return fmt.Errorf("expected %d, but got %s", i, data)
+		}
+		i++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if i != currInd {
+		t.Fatalf("read %d frames, but wrote %d frames", i, currInd)
+	}
+
+	// Files and directories are created with the given modes, and the scratch isn't preallocated.
+	for _, dir := range []string{walDir, scratchDir(walDir)} {
+		fi, err := os.Stat(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != opts.DirMode {
+			t.Fatalf("expected %s to have mode %v, but got %v", dir, opts.DirMode, fi.Mode().Perm())
+		}
+	}
+	if err := wal.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(wal.scratchRW.f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != opts.FileMode {
+		t.Fatalf("expected the scratch to have mode %v, but got %v", opts.FileMode, fi.Mode().Perm())
+	}
+	if size := int(fi.Size()); size != wal.scratchRW.size() {
+		t.Fatalf("expected the scratch to not be preallocated, but its size is %d", size)
+	}
+}
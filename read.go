@@ -0,0 +1,201 @@
+package wal
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// Read returns the record with the given index. ErrCompacted is returned if the index precedes
+// the first index of the WAL, and ErrOutOfRange if it follows the last one.
+//
+// The record is looked up directly, through the footer of the segment holding it (see ReadFrom),
+// and is kept in memory for subsequent reads (see Options.ReadCacheSize). It must not be
+// modified.
+func (wal *WAL) Read(index uint64) ([]byte, error) {
+	rec, err := wal.ReadRecord(index)
+	return rec.Data, err
+}
+
+// ReadRecord is like Read, but returns the record along with its metadata.
+func (wal *WAL) ReadRecord(index uint64) (Record, error) {
+	recs, err := wal.ReadRangeRecords(index, index+1, 0)
+	if err != nil {
+		return Record{}, err
+	}
+	return recs[0], nil
+}
+
+// ReadRange returns the records with indices in [lo, hi), like Read. If maxBytes is non-zero, the
+// records are cut short once their total size would exceed maxBytes, but the first record is
+// returned regardless. ErrCompacted is returned if lo precedes the first index of the WAL, and
+// ErrOutOfRange if hi-1 follows the last one.
+//
+// The records must not be modified.
+func (wal *WAL) ReadRange(lo, hi, maxBytes uint64) ([][]byte, error) {
+	recs, err := wal.ReadRangeRecords(lo, hi, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	var records [][]byte
+	for _, rec := range recs {
+		records = append(records, rec.Data)
+	}
+	return records, nil
+}
+
+// ReadRangeRecords is like ReadRange, but returns the records along with their metadata. maxBytes
+// only counts their data.
+func (wal *WAL) ReadRangeRecords(lo, hi, maxBytes uint64) ([]Record, error) {
+	if lo > hi {
+		return nil, fmt.Errorf("invalid range: lo %d is greater than hi %d", lo, hi)
+	}
+	wal.mu.Lock()
+	first, last := wal.firstIndex(), wal.lastInd
+	wal.mu.Unlock()
+	if lo < first {
+		return nil, ErrCompacted
+	}
+	if hi > last+1 {
+		return nil, ErrOutOfRange
+	}
+
+	var records []Record
+	var size uint64
+	// add adds the record to records, unless that would exceed maxBytes.
+	add := func(rec Record) bool {
+		if maxBytes > 0 && len(records) > 0 && size+uint64(len(rec.Data)) > maxBytes {
+			return false
+		}
+		records = append(records, rec)
+		size += uint64(len(rec.Data))
+		return true
+	}
+
+	// Take as many records from the cache as possible, then read the rest in one go.
+	gen := wal.cache.generation()
+	ind := lo
+	for ; ind < hi; ind++ {
+		rec, ok := wal.cache.get(ind)
+		if !ok {
+			break
+		}
+		if !add(rec) {
+			return records, nil
+		}
+	}
+	if ind == hi {
+		return records, nil
+	}
+	it, err := wal.ReadFrom(ind)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	for ; ind < hi; ind++ {
+		rec, err := it.NextRecord()
+		if err == io.EOF {
+			// the WAL has been truncated since
+			return nil, ErrOutOfRange
+		}
+		if err != nil {
+			return nil, err
+		}
+		wal.cache.add(gen, rec)
+		if !add(rec) {
+			break
+		}
+	}
+	return records, nil
+}
+
+// SeekTime returns the index of the first record written at or after t (see Record.Time), i.e.
+// the index to read from to replay everything written since t. If no record was written at or
+// after t, LastIndex()+1 is returned.
+//
+// The published segment that t falls in is found by a binary search over the time ranges recorded
+// in the footers of the published segments, which are kept in memory, so that only the records of
+// that segment are read. Records are taken to be in time order, which the times the WAL gives
+// them are. If records were given times out of order instead (see Record.Time), the index
+// returned is undefined: it may be that of any record at or after t, or LastIndex()+1 regardless.
+// Records of segments written before records were given a time have none, and are skipped over.
+func (wal *WAL) SeekTime(t time.Time) (uint64, error) {
+	wal.mu.Lock()
+	first, last := wal.firstIndex(), wal.lastInd
+	// Segments without a footer have a zero time range, and no record with a time either.
+	pubSegs := wal.pubSegs
+	i := sort.Search(len(pubSegs), func(i int) bool {
+		return !pubSegs[i].maxTime.Before(t)
+	})
+	if i < len(pubSegs) && !pubSegs[i].minTime.Before(t) {
+		// t precedes the whole segment
+		ind := pubSegs[i].ind
+		wal.mu.Unlock()
+		if ind < first {
+			ind = first
+		}
+		return ind, nil
+	}
+	// The segment t falls in holds the record, unless the range was widened past the times of its
+	// records (see buildFooter), in which case it is one of the segments after it.
+	var seqs []uint64
+	for _, seg := range pubSegs[i:] {
+		seqs = append(seqs, seg.seq)
+	}
+	seqs = append(seqs, wal.scratchRW.segment.seq)
+	wal.mu.Unlock()
+
+	for _, seq := range seqs {
+		ind, ok, err := wal.seekTimeIn(seq, t)
+		if err == io.EOF {
+			// the scratch segment doesn't exist (yet)
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			if ind < first {
+				ind = first
+			}
+			return ind, nil
+		}
+	}
+	return last + 1, nil
+}
+
+// seekTimeIn looks for the first record written at or after t in the segment with the given seq,
+// as described by SeekTime. ok is false if every record of the segment was written before t.
+func (wal *WAL) seekTimeIn(seq uint64, t time.Time) (ind uint64, ok bool, err error) {
+	sr, err := wal.openSegment(seq, false, wal.newPubReader)
+	if err != nil {
+		return 0, false, err
+	}
+	defer sr.Close()
+	if ft := sr.footer; ft != nil {
+		if ft.maxTime.Before(t) {
+			return 0, false, nil
+		}
+		if !ft.minTime.Before(t) {
+			return sr.segment.ind, true, nil
+		}
+	}
+
+	for ind = sr.segment.ind; ; ind++ {
+		data, _, err := sr.deframe()
+		if err == io.EOF {
+			return 0, false, nil
+		}
+		if err != nil {
+			return 0, false, err
+		}
+		rec, err := decodeRecord(ind, sr.deframer.flags, data)
+		if err != nil {
+			return 0, false, err
+		}
+		if !rec.Time.IsZero() && !rec.Time.Before(t) {
+			return ind, true, nil
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package wal
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_WAL_Read(t *testing.T) {
+	fs := NewMemFS()
+	opts := &Options{SegmentSize: testSegmentSize, FS: fs, ReadCacheSize: 8}
+	wal, err := OpenWAL("wal", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	currInd := 0
+	for len(wal.pubSegs) < 5 {
+		var b Batch
+		b.Add(numAndInc(&currInd))
+		b.Add(numAndInc(&currInd))
+		if _, err := wal.WriteBatch(&b); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// expectRead checks that every record in [first, last] can be read, in any order, and that
+	// none other can.
+	expectRead := func(wal *WAL, first, last uint64) {
+		t.Helper()
+		for _, ind := range []uint64{last, first, (first + last) / 2, last} {
+			if data, err := wal.Read(ind); err != nil || string(data) != fmt.Sprintf("%d", ind-1) {
+				t.Fatalf("expected record %d, but got %s (%v)", ind, data, err)
+			}
+		}
+		for ind := first; ind <= last; ind++ {
+			if data, err := wal.Read(ind); err != nil || string(data) != fmt.Sprintf("%d", ind-1) {
+				t.Fatalf("expected record %d, but got %s (%v)", ind, data, err)
+			}
+		}
+		if _, err := wal.Read(first - 1); err != ErrCompacted {
+			t.Fatalf("expected ErrCompacted, but got %v", err)
+		}
+		if _, err := wal.Read(last + 1); err != ErrOutOfRange {
+			t.Fatalf("expected ErrOutOfRange, but got %v", err)
+		}
+	}
+	expectRead(wal, 1, uint64(currInd))
+
+	// Ranges span segments, and are cut short by maxBytes, though never to nothing.
+	var all [][]byte
+	var size uint64
+	for i := 0; i < currInd; i++ {
+		all = append(all, []byte(fmt.Sprintf("%d", i)))
+		size += uint64(len(all[i]))
+	}
+	for _, tt := range []struct {
+		lo, hi, maxBytes uint64
+		want             [][]byte
+	}{
+		{1, uint64(currInd) + 1, 0, all},
+		{1, uint64(currInd) + 1, size, all},
+		{1, uint64(currInd) + 1, size - 1, all[:currInd-1]},
+		{1, uint64(currInd) + 1, 1, all[:1]},
+		{5, 5, 0, nil},
+		{5, 15, 0, all[4:14]},
+		{5, 15, 4, all[4:8]},
+	} {
+		got, err := wal.ReadRange(tt.lo, tt.hi, tt.maxBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("expected ReadRange(%d, %d, %d) to return %q, but got %q",
+				tt.lo, tt.hi, tt.maxBytes, tt.want, got)
+		}
+	}
+	if _, err := wal.ReadRange(2, 1, 0); err == nil {
+		t.Fatal("expected an error for an invalid range")
+	}
+	if _, err := wal.ReadRange(1, uint64(currInd)+2, 0); err != ErrOutOfRange {
+		t.Fatalf("expected ErrOutOfRange, but got %v", err)
+	}
+
+	// Records discarded by TruncateBack aren't read from the cache once they're written anew, in
+	// the scratch segment or in a published one.
+	for _, back := range []uint64{uint64(currInd) - 1, wal.pubSegs[1].ind + 1} {
+		if _, err := wal.Read(back + 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := wal.TruncateBack(back); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := wal.Write([]byte("anew")); err != nil {
+			t.Fatal(err)
+		}
+		if data, err := wal.Read(back + 1); err != nil || string(data) != "anew" {
+			t.Fatalf("expected the record written anew, but got %s (%v)", data, err)
+		}
+		if err := wal.TruncateBack(back); err != nil {
+			t.Fatal(err)
+		}
+		currInd = int(back)
+		for len(wal.pubSegs) < 3 {
+			if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		expectRead(wal, 1, uint64(currInd))
+	}
+
+	// Nor are records discarded by TruncateFront.
+	if err := wal.TruncateFront(wal.pubSegs[1].ind + 1); err != nil {
+		t.Fatal(err)
+	}
+	expectRead(wal, wal.FirstIndex(), uint64(currInd))
+
+	// Once reopened, the scratch segment is indexed anew, by both the writer and readers.
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wal, err = OpenWAL("wal", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	expectRead(wal, wal.FirstIndex(), uint64(currInd))
+	if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+		t.Fatal(err)
+	}
+	expectRead(wal, wal.FirstIndex(), uint64(currInd))
+	ro, err := OpenReadOnly("wal", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	expectRead(ro, wal.FirstIndex(), uint64(currInd))
+}
+
+func Test_WAL_SeekTime(t *testing.T) {
+	fs := NewMemFS()
+	opts := &Options{SegmentSize: testSegmentSize, FS: fs}
+	wal, err := OpenWAL("wal", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Write a record every second, some of them in batches, until a few segments have been cut.
+	base := time.Unix(1000, 0)
+	at := func(ind uint64) time.Time { return base.Add(time.Duration(ind) * time.Second) }
+	if ind, err := wal.SeekTime(base); err != nil || ind != 1 {
+		t.Fatalf("expected index 1 of the empty WAL, but got %d (%v)", ind, err)
+	}
+	for len(wal.pubSegs) < 4 {
+		ind := wal.LastIndex() + 1
+		if ind%3 == 0 {
+			var b Batch
+			b.AddRecord(Record{Time: at(ind), Data: []byte("x")})
+			b.AddRecord(Record{Time: at(ind + 1), Data: []byte("x")})
+			if _, err := wal.WriteBatch(&b); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if _, err := wal.AppendRecord(Record{Time: at(ind), Data: []byte("x")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The footer of every published segment spans the times of its records.
+	for i, seg := range wal.pubSegs {
+		sr, err := seg.openPublished(wal.newPubReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ft := sr.footer
+		sr.Close()
+		if !ft.minTime.Equal(at(seg.ind)) || !ft.maxTime.Equal(at(ft.lastInd)) {
+			t.Fatalf("expected segment %d to span [%v, %v], but got [%v, %v]",
+				i, at(seg.ind), at(ft.lastInd), ft.minTime, ft.maxTime)
+		}
+	}
+
+	// expectSeek checks that the first record written at or after every time is found, by reading
+	// a single segment at most.
+	expectSeek := func(wal *WAL, first, last uint64) {
+		t.Helper()
+		opens := 0
+		fs.SetFault(func(op, name string) error {
+			if op == "OpenFile" && strings.HasSuffix(name, SegExt) {
+				opens++
+			}
+			return nil
+		})
+		defer fs.SetFault(nil)
+		for ind := uint64(0); ind <= last+1; ind++ {
+			for _, tm := range []time.Time{at(ind), at(ind).Add(-time.Millisecond)} {
+				want := ind
+				if want < first {
+					want = first
+				}
+				opens = 0
+				if got, err := wal.SeekTime(tm); err != nil || got != want {
+					t.Fatalf("expected SeekTime(%v) to be %d, but got %d (%v)", tm, want, got, err)
+				}
+				if opens > 1 {
+					t.Fatalf("expected SeekTime(%v) to open one segment at most, but it opened %d", tm, opens)
+				}
+			}
+		}
+		if got, err := wal.SeekTime(at(last + 10)); err != nil || got != last+1 {
+			t.Fatalf("expected %d, but got %d (%v)", last+1, got, err)
+		}
+	}
+	last := wal.LastIndex()
+	expectSeek(wal, 1, last)
+
+	// Records compacted away aren't returned, and the index survives reopening, read-only or not.
+	if err := wal.TruncateFront(wal.pubSegs[1].ind + 1); err != nil {
+		t.Fatal(err)
+	}
+	first := wal.FirstIndex()
+	expectSeek(wal, first, last)
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wal, err = OpenWAL("wal", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	expectSeek(wal, first, last)
+	ro, err := OpenReadOnly("wal", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	expectSeek(ro, first, last)
+
+	// Records written by Write are given the time they were written, in the scratch segment as
+	// well as in published ones.
+	for len(wal.pubSegs) < 6 || wal.scratchRW.segment.ind == wal.LastIndex()+1 {
+		if _, err := wal.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, err := wal.SeekTime(at(last + 10)); err != nil || got != last+1 {
+		t.Fatalf("expected %d, but got %d (%v)", last+1, got, err)
+	}
+	var times []time.Time
+	for ind := last + 1; ind <= wal.LastIndex(); ind++ {
+		rec, err := wal.ReadRecord(ind)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.Time.IsZero() {
+			t.Fatalf("expected record %d to have a time", ind)
+		}
+		times = append(times, rec.Time)
+	}
+	for i, tm := range times {
+		// the first record written at the same time (on a coarse clock)
+		want := i
+		for want > 0 && times[want-1].Equal(tm) {
+			want--
+		}
+		if got, err := wal.SeekTime(tm); err != nil || got != last+1+uint64(want) {
+			t.Fatalf("expected SeekTime(%v) to be %d, but got %d (%v)", tm, last+1+uint64(want), got, err)
+		}
+	}
+	if got, err := wal.SeekTime(time.Now().Add(time.Hour)); err != nil || got != wal.LastIndex()+1 {
+		t.Fatalf("expected %d, but got %d (%v)", wal.LastIndex()+1, got, err)
+	}
+}
+
+func Test_readCache(t *testing.T) {
+	c := newReadCache(2)
+	gen := c.generation()
+	c.add(gen, Record{Index: 1})
+	c.add(gen, Record{Index: 2})
+	if rec, ok := c.get(1); !ok || rec.Index != 1 {
+		t.Fatalf("expected record 1 to be cached, but got %+v (%v)", rec, ok)
+	}
+
+	// The least recently used record is evicted first.
+	c.add(gen, Record{Index: 3})
+	if _, ok := c.get(2); ok {
+		t.Fatal("expected record 2 to be evicted")
+	}
+	for _, ind := range []uint64{1, 3} {
+		if _, ok := c.get(ind); !ok {
+			t.Fatalf("expected record %d to be cached", ind)
+		}
+	}
+
+	// Records read before a TruncateBack aren't cached after it.
+	c.truncateBack(1)
+	if _, ok := c.get(3); ok {
+		t.Fatal("expected record 3 to be evicted")
+	}
+	c.add(gen, Record{Index: 2})
+	if _, ok := c.get(2); ok {
+		t.Fatal("expected record 2 not to be cached")
+	}
+	c.add(c.generation(), Record{Index: 2})
+	if _, ok := c.get(2); !ok {
+		t.Fatal("expected record 2 to be cached")
+	}
+
+	c.truncateFront(2)
+	if _, ok := c.get(1); ok {
+		t.Fatal("expected record 1 to be evicted")
+	}
+}
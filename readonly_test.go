@@ -0,0 +1,309 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func Test_OpenReadOnly(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(baseDir)
+	walDir := filepath.Join(baseDir, "wal")
+	opts := &Options{SegmentSize: testSegmentSize}
+
+	if _, err := OpenReadOnly(walDir, opts); !os.IsNotExist(err) {
+		t.Fatalf("expected a not-exist error, but got %v", err)
+	}
+
+	// Write past a couple of cuts, and leave part of a batch in the scratch segment, as if the
+	// writer were in the middle of writing it.
+	wal, err := OpenWAL(walDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	currInd := 0
+	for len(wal.pubSegs) < 2 {
+		if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	last := uint64(currInd)
+	if _, err := wal.scratchRW.framer.frameWithFlags([]byte("partial"), batchFlag); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.scratchRW.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The WAL can be read while it is open for writing, without modifying it.
+	before := readDir(t, walDir)
+	ro, err := OpenReadOnly(walDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ro.FirstIndex() != 1 || ro.LastIndex() != last {
+		t.Fatalf("expected the WAL to span [1, %d], but got [%d, %d]", last, ro.FirstIndex(), ro.LastIndex())
+	}
+	expectRecords(t, ro, 1, last)
+	it, err := ro.ReadSyncedFrom(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ind, _, err := it.Next(); err != nil || ind != last {
+		t.Fatalf("expected record %d, but got %d (%v)", last, ind, err)
+	}
+	it.Close()
+	if _, err := ro.Write([]byte("x")); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, but got %v", err)
+	}
+	if _, err := ro.AppendSync([]byte("x")); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, but got %v", err)
+	}
+	var b Batch
+	b.Add([]byte("x"))
+	if _, err := ro.WriteBatch(&b); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, but got %v", err)
+	}
+	if err := ro.Sync(); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, but got %v", err)
+	}
+	if err := ro.TruncateFront(2); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, but got %v", err)
+	}
+	if err := ro.TruncateBack(1); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, but got %v", err)
+	}
+	if after := readDir(t, walDir); !reflect.DeepEqual(before, after) {
+		t.Fatalf("expected the WAL to be left as it was, but it went from %v to %v", before, after)
+	}
+
+	// The writer discards the partial batch and carries on, cutting the scratch segment the reader
+	// knows of, and deleting the first segment. What is left can still be read, as of opening.
+	if err := wal.scratchRW.truncate(last + 1 - wal.scratchRW.segment.ind); err != nil {
+		t.Fatal(err)
+	}
+	for len(wal.pubSegs) < 4 {
+		if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := wal.TruncateFront(wal.pubSegs[1].ind); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ro.ReadFrom(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := ro.Visit(func([]byte) error { return nil }); err != ErrCompacted {
+		t.Fatalf("expected ErrCompacted, but got %v", err)
+	}
+	expectRecords(t, ro, wal.pubSegs[0].ind, last)
+	if err := ro.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a writer, readers hold one off until they are closed.
+	ro, err = OpenReadOnly(walDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ro2, err := OpenReadOnly(walDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenWAL(walDir, opts); err != ErrLocked {
+		t.Fatalf("expected ErrLocked, but got %v", err)
+	}
+	expectRecords(t, ro2, ro.FirstIndex(), uint64(currInd))
+	ro.Close()
+	ro2.Close()
+	wal, err = OpenWAL(walDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.Close()
+}
+
+func Test_OpenReadOnly_NoWrites(t *testing.T) {
+	fs := NewMemFS()
+	opts := &Options{SegmentSize: testSegmentSize, FS: fs}
+	wal, err := OpenWAL("wal", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	currInd := 0
+	for len(wal.pubSegs) < 2 {
+		if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := wal.Write(numAndInc(&currInd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	seg := wal.scratchRW.segment
+	scratchName := segmentFileName(scratchDir(seg.dir), seg.seq, seg.ind)
+
+	// readOnly reads the WAL, failing any attempt to modify it.
+	readOnly := func(last uint64) {
+		t.Helper()
+		fs.SetFault(func(op, name string) error {
+			switch op {
+			case "Rename", "Remove", "Mkdir", "SyncDir", "Lock", "Write", "Truncate", "Sync", "Preallocate":
+				t.Errorf("unexpected %s of %s", op, name)
+				return syscall.EROFS
+			}
+			return nil
+		})
+		defer fs.SetFault(nil)
+		ro, err := OpenReadOnly("wal", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ro.Close()
+		expectRecords(t, ro, 1, last)
+	}
+
+	// Tear off the end of the last record, which OpenWAL would truncate.
+	f, err := fs.OpenFile(scratchName, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(int64(segmentHeaderSize + n - 1)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	currInd--
+	readOnly(uint64(currInd))
+
+	// Leave a stale scratch segment behind, as a crash in the middle of publishing would, which
+	// OpenWAL would remove. (Publish it by hand, once OpenWAL has repaired the torn record.)
+	if wal, err = OpenWAL("wal", opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wal.scratchRW.seal(); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Rename(scratchName, segmentFileName(seg.dir, seg.seq, seg.ind)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SyncDir(seg.dir); err != nil {
+		t.Fatal(err)
+	}
+	fs.Crash(nil)
+	readOnly(uint64(currInd))
+	if _, err := fs.Stat(scratchName); err != nil {
+		t.Fatalf("expected the stale scratch segment to be left alone, but got %v", err)
+	}
+}
+
+// readDir returns the contents of every file in the WAL directory and its scratch directory.
+func readDir(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	for _, dir := range []string{dir, scratchDir(dir)} {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, info := range infos {
+			b, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[filepath.Join(dir, info.Name())] = string(b)
+		}
+	}
+	return files
+}
+
+func Test_OpenReadOnly_TruncateBack(t *testing.T) {
+	fs := NewMemFS()
+	opts := &Options{SegmentSize: 4096, FS: fs}
+	wal, err := OpenWAL("wal", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	currInd := 0
+	for currInd < 5 {
+		if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := wal.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	ro, err := OpenReadOnly("wal", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	expectRecords(t, ro, 1, 5)
+	for ind := uint64(1); ind <= 5; ind++ {
+		if _, err := ro.Read(ind); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The writer discards records within the scratch segment, and writes others in their place.
+	if err := wal.TruncateBack(3); err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{"d", "e", "f", "g"} {
+		if _, err := wal.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := wal.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	ro.mu.Lock()
+	err = ro.refresh()
+	ro.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ro.LastIndex() != 7 {
+		t.Fatalf("expected last index 7, but got %d", ro.LastIndex())
+	}
+	for ind, want := range map[uint64]string{3: "2", 4: "d", 7: "g"} {
+		if data, err := ro.Read(ind); err != nil {
+			t.Fatal(err)
+		} else if string(data) != want {
+			t.Fatalf("expected record %d to be %q, but got %q", ind, want, data)
+		}
+	}
+	var visited []string
+	if err := ro.Visit(func(data []byte) error {
+		visited = append(visited, string(data))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"0", "1", "2", "d", "e", "f", "g"}; !reflect.DeepEqual(visited, want) {
+		t.Fatalf("expected to visit %v, but visited %v", want, visited)
+	}
+}
@@ -0,0 +1,123 @@
+package wal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Flags of frames that carry metadata (see Record). The metadata precedes the data in the frame,
+// so that it is covered by the checksum, in the order of the flags; fields that aren't flagged
+// are left out.
+const (
+	// recordTypeFlag means that the frame carries Record.Type, in 1 byte.
+	recordTypeFlag uint64 = 1 << 33
+
+	// recordTagFlag means that the frame carries Record.Tag, in 8 bytes.
+	recordTagFlag uint64 = 1 << 34
+
+	// recordTimeFlag means that the frame carries Record.Time, in 8 bytes of nanoseconds since
+	// the Unix epoch.
+	recordTimeFlag uint64 = 1 << 35
+
+	// recordMetadataSize is the size of the metadata of a frame, with every field present.
+	recordMetadataSize = 1 + 8 + 8
+)
+
+// Record is a record of the WAL, along with its metadata. Each field of metadata is optional:
+// only those that aren't zero are written, taking up space next to the data in the segment.
+// Records written without any metadata (by Write, say) read back with the zero metadata, but for
+// their time.
+type Record struct {
+	// Index is the index of the record. It is set when the record is read, and ignored when it is
+	// written.
+	Index uint64
+
+	// Type is the type of the record, as defined by the user.
+	Type uint8
+
+	// Tag is any 64-bit value the user wants to associate with the record, such as the Raft term
+	// of an entry.
+	Tag uint64
+
+	// Time is the time the record was written. Every write sets it to the current time if it is
+	// zero, so it is only zero for records of segments written before records were given a time.
+	// A time given by the caller is written as it is, even if it precedes the times of the records
+	// before it, but then SeekTime can't be relied on (see there).
+	Time time.Time
+
+	// Data is the data of the record.
+	Data []byte
+}
+
+// stamp sets the time of the record to the current time, unless it already has one.
+func (rec *Record) stamp() {
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+}
+
+// encodeMetadata encodes the metadata of the record into buf, returning the encoded metadata
+// along with the flags of the frame to write it in.
+func (rec *Record) encodeMetadata(buf *[recordMetadataSize]byte) ([]byte, uint64) {
+	var flags uint64
+	n := 0
+	if rec.Type != 0 {
+		flags |= recordTypeFlag
+		buf[n] = rec.Type
+		n++
+	}
+	if rec.Tag != 0 {
+		flags |= recordTagFlag
+		binary.LittleEndian.PutUint64(buf[n:], rec.Tag)
+		n += 8
+	}
+	if !rec.Time.IsZero() {
+		flags |= recordTimeFlag
+		binary.LittleEndian.PutUint64(buf[n:], uint64(rec.Time.UnixNano()))
+		n += 8
+	}
+	return buf[:n], flags
+}
+
+// metadataSize returns the size of the metadata of the record, once encoded.
+func (rec *Record) metadataSize() int {
+	n := 0
+	if rec.Type != 0 {
+		n++
+	}
+	if rec.Tag != 0 {
+		n += 8
+	}
+	if !rec.Time.IsZero() {
+		n += 8
+	}
+	return n
+}
+
+// decodeRecord decodes the record with the given index from the contents of its frame, which has
+// the given flags. Data refers to the contents.
+func decodeRecord(ind, flags uint64, b []byte) (Record, error) {
+	rec := Record{Index: ind}
+	torn := fmt.Errorf("data corruption: metadata of record %d is torn", ind)
+	if flags&recordTypeFlag != 0 {
+		if len(b) < 1 {
+			return Record{}, torn
+		}
+		rec.Type, b = b[0], b[1:]
+	}
+	if flags&recordTagFlag != 0 {
+		if len(b) < 8 {
+			return Record{}, torn
+		}
+		rec.Tag, b = binary.LittleEndian.Uint64(b), b[8:]
+	}
+	if flags&recordTimeFlag != 0 {
+		if len(b) < 8 {
+			return Record{}, torn
+		}
+		rec.Time, b = time.Unix(0, int64(binary.LittleEndian.Uint64(b))), b[8:]
+	}
+	rec.Data = b
+	return rec, nil
+}
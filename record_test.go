@@ -0,0 +1,174 @@
+package wal
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Record(t *testing.T) {
+	fs := NewMemFS()
+	opts := &Options{SegmentSize: testSegmentSize, FS: fs}
+	wal, err := OpenWAL("wal", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Write records with every combination of metadata, individually and in batches, along with
+	// records without any but their time, until a couple of segments have been cut.
+	start := time.Now()
+	at := time.Unix(0, 1234567890)
+	var want []Record
+	// stamped is set for the records that were written without a time, which are given the time
+	// of the write.
+	var stamped []bool
+	for i := 0; len(wal.pubSegs) < 2; i++ {
+		rec := Record{
+			Type: uint8(i % 2),
+			Tag:  uint64(i % 3),
+			Data: []byte(strings.Repeat("x", i%5)),
+		}
+		if i%4 == 0 {
+			rec.Time = at
+		}
+		switch i % 3 {
+		case 0:
+			if _, err := wal.Write(rec.Data); err != nil {
+				t.Fatal(err)
+			}
+			want, stamped = append(want, Record{Data: rec.Data}), append(stamped, true)
+		case 1:
+			if _, err := wal.AppendRecord(rec); err != nil {
+				t.Fatal(err)
+			}
+			want, stamped = append(want, rec), append(stamped, rec.Time.IsZero())
+		case 2:
+			var b Batch
+			b.AddRecord(rec)
+			b.Add(rec.Data)
+			if _, err := wal.WriteBatch(&b); err != nil {
+				t.Fatal(err)
+			}
+			want, stamped = append(want, rec), append(stamped, rec.Time.IsZero())
+			want, stamped = append(want, Record{Data: rec.Data}), append(stamped, true)
+		}
+	}
+	end := time.Now()
+
+	// expectRecords checks that got are the records that were written.
+	expectRecords := func(got []Record) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Fatalf("expected %d records, but got %d", len(want), len(got))
+		}
+		for i, rec := range got {
+			w := want[i]
+			w.Index = uint64(i + 1)
+			if stamped[i] {
+				if rec.Time.Before(start) || rec.Time.After(end) {
+					t.Fatalf("expected record %d to have been written at the time, but got %v", w.Index, rec.Time)
+				}
+				w.Time = rec.Time
+			}
+			if rec.Index != w.Index || rec.Type != w.Type || rec.Tag != w.Tag || !rec.Time.Equal(w.Time) ||
+				!bytes.Equal(rec.Data, w.Data) {
+				t.Fatalf("expected %+v, but got %+v", w, rec)
+			}
+		}
+	}
+	visit := func(wal *WAL) []Record {
+		t.Helper()
+		var got []Record
+		if err := wal.VisitRecords(func(rec Record) error {
+			got = append(got, rec)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	expectRecords(visit(wal))
+
+	// Records can be read individually too, and survive reopening.
+	var got []Record
+	for ind := uint64(1); ind <= wal.LastIndex(); ind++ {
+		rec, err := wal.ReadRecord(ind)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, rec)
+	}
+	expectRecords(got)
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wal, err = OpenWAL("wal", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	expectRecords(visit(wal))
+	it, err := wal.ReadFrom(wal.LastIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	if rec, err := it.NextRecord(); err != nil || rec.Index != wal.LastIndex() {
+		t.Fatalf("expected record %d, but got %+v (%v)", wal.LastIndex(), rec, err)
+	}
+	if _, err := it.NextRecord(); err != io.EOF {
+		t.Fatalf("expected io.EOF, but got %v", err)
+	}
+	got, err = wal.ReadRangeRecords(1, wal.LastIndex()+1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRecords(got)
+
+	// Records synced through group commit carry their metadata too, and are stamped likewise, as
+	// seen by iterators that follow the WAL.
+	for _, rec := range []Record{{Type: 7, Tag: 8, Time: at, Data: []byte("synced")}, {Data: []byte("stamped")}} {
+		ind, err := wal.AppendRecordSync(rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := it.NextRecordWait(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.Time.IsZero() {
+			if got.Time.Before(end) || got.Time.After(time.Now()) {
+				t.Fatalf("expected record %d to have been written at the time, but got %v", ind, got.Time)
+			}
+			rec.Time = got.Time
+		}
+		rec.Index = ind
+		if !reflect.DeepEqual(got, rec) {
+			t.Fatalf("expected %+v, but got %+v", rec, got)
+		}
+	}
+}
+
+func Test_decodeRecord(t *testing.T) {
+	rec := Record{Type: 1, Tag: 2, Time: time.Unix(0, 3000000004), Data: []byte("data")}
+	var buf [recordMetadataSize]byte
+	meta, flags := rec.encodeMetadata(&buf)
+	if len(meta) != rec.metadataSize() {
+		t.Fatalf("expected %d bytes of metadata, but got %d", rec.metadataSize(), len(meta))
+	}
+	b := append(append([]byte{}, meta...), rec.Data...)
+	got, err := decodeRecord(5, flags, b)
+	rec.Index = 5
+	if err != nil || !reflect.DeepEqual(got, rec) {
+		t.Fatalf("expected %+v, but got %+v (%v)", rec, got, err)
+	}
+
+	// Metadata that is cut short is reported as such, rather than read into the data.
+	if _, err := decodeRecord(5, flags, meta[:len(meta)-1]); err == nil || !strings.Contains(err.Error(), "torn") {
+		t.Fatalf("expected the metadata to be torn, but got %v", err)
+	}
+}
@@ -2,13 +2,17 @@ package wal
 
 import (
 	"bufio"
+	"encoding/binary"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
+	"time"
 )
 
 const (
@@ -19,10 +23,9 @@ const (
 	// executable permission (so we can cd into it)
 	privateDirMode = 0700
 
-	// SegmentSizeBytes is the preallocated size of each segment file.
-	// The actual size might actually be larger than this. In general, the
-	// default value should be used, but this is defined as an exported variable
-	// so that tests can set a different segment size.
+	// SegmentSizeBytes is the default preallocated size of each segment file (see
+	// Options.SegmentSize). The actual size might actually be larger than this, since a segment is
+	// only cut off once a write crosses it.
 	SegmentSizeBytes = 64 * 1000 * 1000
 
 	// SegExt is the segment file extension.
@@ -37,6 +40,18 @@ var (
 	nonExistingSegment    = segment{}
 )
 
+// errorRename is returned by publish if the scratch segment couldn't be renamed into the WAL
+// directory. By then, the segment has been synced, and it is left open, so it can still be
+// written to.
+type errorRename struct {
+	err error
+}
+
+// Error implements error for errorRename.
+func (err errorRename) Error() string {
+	return fmt.Sprintf("failed to publish segment: %v", err.err)
+}
+
 type segment struct {
 	// seq and ind of the beginning of the segment
 	seq, ind uint64
@@ -44,92 +59,200 @@ type segment struct {
 	// dir is the directory of the segment file
 	dir string
 
-	// sizeHint is an indication of how large the segment file can get (in bytes)
-	sizeHint int
+	// opts are the options of the WAL the segment belongs to
+	opts *Options
+
+	// minTime and maxTime are the time range of the records of a published segment, as recorded
+	// in its footer, which SeekTime looks up without opening the segment (see readTimeRanges).
+	// They are zero if the segment has no footer.
+	minTime, maxTime time.Time
 }
 
-func (s segment) openPublished(reuseReader func(*os.File) *bufio.Reader) (*segmentReader, error) {
-	f, err := os.OpenFile(segmentFileName(s.dir, s.seq, s.ind), os.O_RDONLY, privateFileMode)
+// openPublished opens a published segment for reading. Published segments are immutable, so
+// the file is not locked; this lets any number of readers open the same segment at once. If the
+// segment has a footer, reads are bounded to the frames before it.
+func (s segment) openPublished(reuseReader func(io.Reader) *bufio.Reader) (*segmentReader, error) {
+	f, err := s.opts.FS.OpenFile(segmentFileName(s.dir, s.seq, s.ind), os.O_RDONLY, 0)
 	if err != nil {
 		return nil, err
 	}
-	if err := lockFileNonBlocking(f); err != nil {
+	br := reuseReader(f)
+	h, err := s.readHeader(br)
+	if err != nil {
 		f.Close()
 		return nil, err
 	}
-	br := reuseReader(f)
 	sr := segmentReader{
 		segment:  s,
-		deframer: newDeframer(br),
+		header:   h,
+		deframer: newDeframerAt(br, h.size()),
 		f:        f,
 		br:       br,
 	}
+	if h.version != 0 {
+		if sr.footer, err = sr.readFooter(); err != nil {
+			f.Close()
+			return nil, err
+		}
+		// Reading the header may have buffered part of the footer, so start over from the
+		// first frame.
+		if err := sr.seek(s.ind); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
 	return &sr, nil
 }
 
-func (s segment) _newScratch(
-	flag int,
-	create bool,
-	reuseReader func(*os.File) *bufio.Reader,
-	reuseWriter func(*os.File) *bufio.Writer) (*segmentReadWriter, error) {
-	dirF, err := os.Open(s.dir)
+// openScratchReader opens the scratch segment for reading. The file is not locked since the
+// writer holds the lock. Reads are bounded to the first limit bytes, i.e. to what the writer has
+// flushed (or synced) so far; the bound can be raised later through segmentReader.lr.
+func (s segment) openScratchReader(
+	limit int64,
+	reuseReader func(io.Reader) *bufio.Reader,
+) (*segmentReader, error) {
+	return s.openLimited(scratchDir(s.dir), limit, reuseReader)
+}
+
+// openReadOnlyScratch is like openScratchReader, for a WAL opened with OpenReadOnly. If the
+// writer has published the segment in the meantime, the published segment is opened instead.
+func (s segment) openReadOnlyScratch(
+	limit int64,
+	reuseReader func(io.Reader) *bufio.Reader,
+) (*segmentReader, error) {
+	sr, err := s.openScratchReader(limit, reuseReader)
+	if os.IsNotExist(err) {
+		sr, err = s.openLimited(s.dir, limit, reuseReader)
+	}
+	return sr, err
+}
+
+// openLimited opens the segment file in dir for reading, bounded to the first limit bytes.
+func (s segment) openLimited(
+	dir string,
+	limit int64,
+	reuseReader func(io.Reader) *bufio.Reader,
+) (*segmentReader, error) {
+	f, err := s.opts.FS.OpenFile(segmentFileName(dir, s.seq, s.ind), os.O_RDONLY, 0)
 	if err != nil {
 		return nil, err
 	}
+	lr := &limitReader{r: f, limit: limit}
+	br := reuseReader(lr)
+	h, err := s.readHeader(br)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	sr := segmentReader{
+		segment:  s,
+		header:   h,
+		deframer: newDeframerAt(br, h.size()),
+		f:        f,
+		br:       br,
+		lr:       lr,
+	}
+	return &sr, nil
+}
 
-	f, err := os.OpenFile(segmentFileName(scratchDir(s.dir), s.seq, s.ind), flag, privateFileMode)
+func (s segment) _newScratch(
+	flag int,
+	create bool,
+	reuseReader func(io.Reader) *bufio.Reader,
+	reuseWriter func(io.Writer) *bufio.Writer) (*segmentReadWriter, error) {
+	name := segmentFileName(scratchDir(s.dir), s.seq, s.ind)
+	f, err := s.opts.FS.OpenFile(name, flag, s.opts.FileMode)
 	if err != nil {
-		dirF.Close()
 		return nil, err
 	}
-	if err := lockFileNonBlocking(f); err != nil {
-		dirF.Close()
+	lock, err := s.opts.FS.Lock(name)
+	if err != nil {
 		f.Close()
 		return nil, err
 	}
-	if create {
-		if err := preallocate(f, int64(s.sizeHint)); err != nil {
-			dirF.Close()
+	if create && !s.opts.NoPreallocate {
+		if err := f.Preallocate(int64(s.opts.SegmentSize)); err != nil {
+			lock.Close()
 			f.Close()
 			return nil, err
 		}
 	}
 	br := reuseReader(f)
+	var h segmentHeader
+	if create {
+		// Write the header, and make sure the new file survives a crash along with it, so that
+		// the header is in place before any frame is.
+		h = newSegmentHeader(s.seq, s.ind)
+		if _, err := f.Write(h.encode()); err != nil {
+			lock.Close()
+			f.Close()
+			return nil, err
+		}
+		if err := f.Sync(); err != nil {
+			lock.Close()
+			f.Close()
+			return nil, err
+		}
+		if err := s.opts.FS.SyncDir(scratchDir(s.dir)); err != nil {
+			lock.Close()
+			f.Close()
+			return nil, err
+		}
+	} else if h, err = s.readHeader(br); err != nil {
+		lock.Close()
+		f.Close()
+		return nil, err
+	}
 	bw := reuseWriter(f)
+	body := crc32.New(crcTable)
 	srw := segmentReadWriter{
 		segmentReader: segmentReader{
 			segment:  s,
-			deframer: newDeframer(br),
+			header:   h,
+			deframer: newDeframerAt(br, h.size()),
 			f:        f,
 			br:       br,
 		},
-		framer: newFramer(bw),
-		bw:     bw,
-		dirF:   dirF,
+		framer:  newFramer(io.MultiWriter(bw, body)),
+		bw:      bw,
+		lock:    lock,
+		flushed: int64(h.size()),
+		synced:  int64(h.size()),
+		body:    body,
 	}
 	return &srw, nil
 }
 
 func (s segment) openScratch(
-	reuseReader func(*os.File) *bufio.Reader,
-	reuseWriter func(*os.File) *bufio.Writer,
+	reuseReader func(io.Reader) *bufio.Reader,
+	reuseWriter func(io.Writer) *bufio.Writer,
 ) (*segmentReadWriter, error) {
 	return s._newScratch(os.O_RDWR, false, reuseReader, reuseWriter)
 }
 
 func (s segment) createScratch(
-	reuseReader func(*os.File) *bufio.Reader,
-	reuseWriter func(*os.File) *bufio.Writer,
+	reuseReader func(io.Reader) *bufio.Reader,
+	reuseWriter func(io.Writer) *bufio.Writer,
 ) (*segmentReadWriter, error) {
-	return s._newScratch(os.O_WRONLY|os.O_CREATE, true, reuseReader, reuseWriter)
+	return s._newScratch(os.O_RDWR|os.O_CREATE, true, reuseReader, reuseWriter)
 }
 
 type segmentReader struct {
 	segment
+	// header is the header of the segment file; the zero segmentHeader if it has none.
+	header segmentHeader
+	// footer is the footer of a published segment, as read by openPublished; nil if it has none.
+	footer *segmentFooter
+	// offsets index the frames of the scratch segment (of the WAL, rather than of its readers),
+	// holding the offset of the frame of every record written so far, in order.
+	offsets []int64
 	*deframer
 
-	f  *os.File
+	f  File
 	br *bufio.Reader
+
+	// lr bounds reads of a scratch segment that is still being written to; nil otherwise.
+	lr *limitReader
 }
 
 func (sr *segmentReader) undo(n int) error {
@@ -143,11 +266,55 @@ func (sr *segmentReader) undo(n int) error {
 	return nil
 }
 
+// frameIntact reports whether the frame at the given offset, which is the last frame read, still
+// holds the rolling checksum it was read with. If it doesn't, the segment has been truncated or
+// rewritten there since (by TruncateBack), and what follows no longer chains onto what was read.
+// The reader is left where it was.
+func (sr *segmentReader) frameIntact(offset int64) (bool, error) {
+	var b [4]byte
+	if _, err := sr.f.Seek(offset+8, io.SeekStart); err != nil {
+		return false, err
+	}
+	_, err := io.ReadFull(sr.f, b[:])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	intact := err == nil && binary.LittleEndian.Uint32(b[:]) == sr.deframer.crc
+	return intact, sr.reposition()
+}
+
+// reposition moves the file offset back to where the deframer is, dropping whatever has been read
+// ahead of it.
+func (sr *segmentReader) reposition() error {
+	pos := int64(sr.deframer.nBytes)
+	if _, err := sr.f.Seek(pos, io.SeekStart); err != nil {
+		return err
+	}
+	if sr.lr != nil {
+		sr.lr.n = pos
+		sr.br.Reset(sr.lr)
+	} else {
+		sr.br.Reset(sr.f)
+	}
+	return nil
+}
+
+// seekToLastFrame positions the reader right after the last intact frame and returns the index
+// of that frame, along with the offset. Frames of a batch are only intact if the entire batch is.
+// If there are no intact frames, the index preceding the segment's first index is returned.
 func (sr *segmentReader) seekToLastFrame() (uint64, int64, error) {
-	init := true
-	var ind uint64
+	return sr.seekToLastFrameFrom(sr.segment.ind - 1)
+}
+
+// seekToLastFrameFrom is like seekToLastFrame, but picks up from the current position of the
+// reader, the last frame read so far having index ind.
+func (sr *segmentReader) seekToLastFrameFrom(ind uint64) (uint64, int64, error) {
+	// rolling checksum as of the last intact frame
+	crc := sr.deframer.crc
+	// frames (and their size in bytes) of a batch whose last frame hasn't been read yet
+	var pending, pendingBytes int
 	for {
-		var n int
+		offset := sr.deframer.nBytes
 		_, n, err := sr.deframer.deframe()
 		if err == io.EOF {
 			break
@@ -167,13 +334,24 @@ func (sr *segmentReader) seekToLastFrame() (uint64, int64, error) {
 			return 0, 0, err
 		}
 
-		if init {
-			init = false
-			ind = sr.segment.ind
-		} else {
-			ind++
+		sr.offsets = append(sr.offsets, int64(offset))
+		if sr.deframer.flags&batchFlag != 0 {
+			pending++
+			pendingBytes += n
+			continue
+		}
+		ind += uint64(pending) + 1
+		pending, pendingBytes = 0, 0
+		crc = sr.deframer.crc
+	}
+	if pendingBytes > 0 {
+		// undo the incomplete batch
+		if err := sr.undo(pendingBytes); err != nil {
+			return 0, 0, err
 		}
+		sr.offsets = sr.offsets[:len(sr.offsets)-pending]
 	}
+	sr.deframer.crc = crc
 	offset, err := sr.f.Seek(0, io.SeekCurrent)
 	return ind, offset, err
 }
@@ -186,67 +364,259 @@ type segmentReadWriter struct {
 	segmentReader
 	*framer
 
-	bw   *bufio.Writer
-	dirF *os.File
+	bw *bufio.Writer
+	// lock is held on the segment file for as long as it is being written to.
+	lock io.Closer
+
+	// flushed and synced are the sizes of the segment (in bytes) as of the last flush to the
+	// page cache and the last fsync, respectively. Readers of the scratch segment may read up to
+	// these offsets.
+	flushed, synced int64
+
+	// body is the checksum of the frames written so far, and minTime and maxTime the range of
+	// the times of their records, untimed being set if any record has no time. They are kept up
+	// to date as frames are written, for the footer (see buildFooter). An existing segment that
+	// is opened for writing has them set by resume.
+	body             hash.Hash32
+	minTime, maxTime time.Time
+	untimed          bool
+
+	metadataBuf [recordMetadataSize]byte
 }
 
-func (srw *segmentReadWriter) frame(data []byte) (int, error) {
-	n, err := srw.framer.frame(data)
-	reachedEnd := err == io.EOF ||
-		srw.segmentReader.deframer.nBytes+srw.framer.nBytes >= srw.segmentReader.segment.sizeHint
-	if reachedEnd {
+// frame writes the record in a frame, along with its metadata. errSegmentSizeReached is returned
+// if the frame was written in full, but the segment is now due to be published.
+func (srw *segmentReadWriter) frame(rec *Record) (int, error) {
+	srw.offsets = append(srw.offsets, int64(srw.size()))
+	srw.addTime(rec.Time)
+	meta, flags := rec.encodeMetadata(&srw.metadataBuf)
+	n, err := srw.framer.frameWithMetadata(meta, rec.Data, flags)
+	if err != nil {
+		return n, err
+	}
+	if srw.size() >= srw.segmentReader.segment.opts.SegmentSize {
 		return n, errSegmentSizeReached
 	}
-	return n, err
+	return n, nil
 }
 
-func (srw *segmentReadWriter) sync() error {
+// frameBatch writes a batch of frames, flagging all but the last one with batchFlag.
+// errSegmentSizeReached is returned if the batch was written in full, but the segment is now due
+// to be published.
+func (srw *segmentReadWriter) frameBatch(batch []Record) (int, error) {
+	nn := 0
+	for i := range batch {
+		meta, flags := batch[i].encodeMetadata(&srw.metadataBuf)
+		if i < len(batch)-1 {
+			flags |= batchFlag
+		}
+		srw.offsets = append(srw.offsets, int64(srw.size()))
+		srw.addTime(batch[i].Time)
+		n, err := srw.framer.frameWithMetadata(meta, batch[i].Data, flags)
+		nn += n
+		if err != nil {
+			return nn, err
+		}
+	}
+	if srw.size() >= srw.segmentReader.segment.opts.SegmentSize {
+		return nn, errSegmentSizeReached
+	}
+	return nn, nil
+}
+
+// addTime widens the time range of the segment to the time of a record written to it (zero if it
+// has none).
+func (srw *segmentReadWriter) addTime(t time.Time) {
+	if t.IsZero() {
+		srw.untimed = true
+		return
+	}
+	if srw.minTime.IsZero() || t.Before(srw.minTime) {
+		srw.minTime = t
+	}
+	if t.After(srw.maxTime) {
+		srw.maxTime = t
+	}
+}
+
+// truncate discards every frame of the segment after the first n, and positions the writer right
+// after them. If the n-th frame is part of a batch, it is turned into the last frame of that
+// batch, so that recovery doesn't mistake the remainder of the batch for a torn one.
+func (srw *segmentReadWriter) truncate(n uint64) error {
+	if err := srw.flush(); err != nil {
+		return err
+	}
+
+	// Re-read the segment from the first frame, for the offset of the n-th frame and the rolling
+	// checksum as of that frame.
+	start := srw.segmentReader.header.size()
+	if _, err := srw.f.Seek(int64(start), io.SeekStart); err != nil {
+		return err
+	}
+	srw.br.Reset(srw.f)
+	d := newDeframerAt(srw.br, start)
+	var lastOffset int
+	for i := uint64(0); i < n; i++ {
+		lastOffset = d.nBytes
+		if _, _, err := d.deframe(); err != nil {
+			return err
+		}
+	}
+	if n > 0 && d.flags&batchFlag != 0 {
+		lenField := binary.LittleEndian.Uint64(d.lenFieldBuf[:]) &^ batchFlag
+		binary.LittleEndian.PutUint64(d.lenFieldBuf[:], lenField)
+		if _, err := srw.f.WriteAt(d.lenFieldBuf[:], int64(lastOffset)); err != nil {
+			return err
+		}
+	}
+	return srw.resume(d.nBytes, d.crc)
+}
+
+// resume positions the writer at offset, discarding everything after it, and continues the
+// rolling checksum from crc. The frames before offset are indexed anew (see reindex). The segment
+// is synced afterwards.
+func (srw *segmentReadWriter) resume(offset int, crc uint32) error {
+	if err := srw.f.Truncate(int64(offset)); err != nil {
+		return err
+	}
+	if err := srw.reindex(offset); err != nil {
+		return err
+	}
+	if opts := srw.segmentReader.segment.opts; !opts.NoPreallocate {
+		if err := srw.f.Preallocate(int64(opts.SegmentSize)); err != nil {
+			return err
+		}
+	}
+	if _, err := srw.f.Seek(int64(offset), io.SeekStart); err != nil {
+		return err
+	}
+	if err := srw.f.Sync(); err != nil {
+		return err
+	}
+	srw.segmentReader.deframer.nBytes = offset
+	srw.framer.nBytes = 0
+	srw.framer.crc = crc
+	srw.bw.Reset(srw.f)
+	srw.flushed, srw.synced = int64(offset), int64(offset)
+	return nil
+}
+
+// reindex re-reads the frames of the segment up to offset end, for their offsets, the checksum
+// of the body and the time range of their records, as kept up to date by frame and frameBatch.
+func (srw *segmentReadWriter) reindex(end int) error {
+	start := srw.segmentReader.header.size()
+	if _, err := srw.f.Seek(int64(start), io.SeekStart); err != nil {
+		return err
+	}
+	srw.body.Reset()
+	srw.br.Reset(io.TeeReader(io.LimitReader(srw.f, int64(end-start)), srw.body))
+	defer srw.br.Reset(srw.f)
+	d := newDeframerAt(srw.br, start)
+	srw.offsets = srw.offsets[:0]
+	srw.minTime, srw.maxTime, srw.untimed = time.Time{}, time.Time{}, false
+	for {
+		offset := d.nBytes
+		data, _, err := d.deframe()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		rec, err := decodeRecord(srw.segmentReader.segment.ind+uint64(len(srw.offsets)), d.flags, data)
+		if err != nil {
+			return err
+		}
+		srw.offsets = append(srw.offsets, int64(offset))
+		srw.addTime(rec.Time)
+	}
+}
+
+// size is the size of the segment in bytes, including frames that haven't been flushed yet.
+func (srw *segmentReadWriter) size() int {
+	return srw.segmentReader.deframer.nBytes + srw.framer.nBytes
+}
+
+// flush writes buffered frames to the page cache, making them visible to readers.
+func (srw *segmentReadWriter) flush() error {
 	if err := srw.bw.Flush(); err != nil {
 		return err
 	}
-	if err := fsync(srw.f); err != nil {
+	srw.flushed = int64(srw.size())
+	return nil
+}
+
+func (srw *segmentReadWriter) sync() error {
+	if err := srw.flush(); err != nil {
 		return err
 	}
+	if err := srw.f.Sync(); err != nil {
+		return err
+	}
+	srw.synced = srw.flushed
 	return nil
 }
 
-func (srw *segmentReadWriter) publish() (segment, error) {
+// seal readies the segment for publishing: it is trimmed to its frames, given a footer (unless
+// the segment predates footers), and synced. The offset at which the frames end is returned.
+func (srw *segmentReadWriter) seal() (int64, error) {
 	// flush just in case we haven't yet
-	if err := srw.bw.Flush(); err != nil {
-		return segment{}, err
+	if err := srw.flush(); err != nil {
+		return 0, err
 	}
 
 	// truncate to avoid wasting space
 	currentOffset, err := srw.f.Seek(0, io.SeekCurrent)
 	if err != nil {
-		return segment{}, err
+		return 0, err
 	}
 	if err := srw.f.Truncate(currentOffset); err != nil {
-		return segment{}, err
+		return 0, err
+	}
+
+	// append the footer, unless the segment predates headers (and footers along with them)
+	if srw.segmentReader.header.version != 0 {
+		footer := srw.buildFooter(currentOffset)
+		if _, err := srw.f.WriteAt(footer.encode(srw.offsets), currentOffset); err != nil {
+			return 0, err
+		}
+		// for publish to hand the time range on to the published segment
+		seg := &srw.segmentReader.segment
+		seg.minTime, seg.maxTime = footer.minTime, footer.maxTime
 	}
 
 	// fsync
-	if err := fsync(srw.f); err != nil {
+	if err := srw.f.Sync(); err != nil {
+		return 0, err
+	}
+	return currentOffset, nil
+}
+
+func (srw *segmentReadWriter) publish() (segment, error) {
+	currentOffset, err := srw.seal()
+	if err != nil {
 		return segment{}, err
 	}
 
 	// move from scratch to published directory
 	seg := srw.segmentReader.segment
 	newName := segmentFileName(seg.dir, seg.seq, seg.ind)
-	if err := os.Rename(srw.f.Name(), newName); err != nil {
-		return segment{}, err
+	if err := seg.opts.FS.Rename(srw.f.Name(), newName); err != nil {
+		// Take the footer off again, for frames to be written where it is. (Even if that fails,
+		// recovery would take it for the end of the frames.)
+		srw.f.Truncate(currentOffset)
+		return segment{}, errorRename{err}
 	}
 
 	// fsync the directory
-	if err := fsync(srw.dirF); err != nil {
+	if err := seg.opts.FS.SyncDir(seg.dir); err != nil {
 		return segment{}, err
 	}
 
-	// close (and unlock) file
+	// close and unlock file
 	if err := srw.f.Close(); err != nil {
 		return segment{}, err
 	}
-	if err := srw.dirF.Close(); err != nil {
+	if err := srw.lock.Close(); err != nil {
 		return segment{}, err
 	}
 
@@ -257,17 +627,46 @@ func (srw *segmentReadWriter) publish() (segment, error) {
 	srw.segmentReader.br = nil
 	srw.framer = nil
 	srw.bw = nil
-	srw.dirF = nil
+	srw.lock = nil
 
 	return seg, nil
 }
 
 func (srw *segmentReadWriter) Close() error {
-	// Flush any remaining in-memory data.
-	if err := srw.bw.Flush(); err != nil {
-		return err
+	if srw.segmentReader.f == nil {
+		// already closed by publish
+		return nil
+	}
+	// Flush any remaining in-memory data. The file is closed (and unlocked) regardless.
+	err := srw.flush()
+	if closeErr := srw.segmentReader.Close(); err == nil {
+		err = closeErr
+	}
+	if lockErr := srw.lock.Close(); err == nil {
+		err = lockErr
+	}
+	return err
+}
+
+// limitReader reads from r up to limit bytes. Unlike io.LimitedReader, the limit is absolute, so
+// it can be raised after reaching it.
+type limitReader struct {
+	r     io.Reader
+	n     int64
+	limit int64
+}
+
+// Read implements io.Reader for limitReader.
+func (lr *limitReader) Read(p []byte) (int, error) {
+	if lr.n >= lr.limit {
+		return 0, io.EOF
 	}
-	return srw.segmentReader.Close()
+	if int64(len(p)) > lr.limit-lr.n {
+		p = p[:lr.limit-lr.n]
+	}
+	n, err := lr.r.Read(p)
+	lr.n += int64(n)
+	return n, err
 }
 
 func segmentFileName(dir string, seq, ind uint64) string {
@@ -290,10 +689,16 @@ func scratchDir(dir string) string {
 	return filepath.Clean(dir) + ScratchSuffix
 }
 
-func findSegments(dir string, sizeHint int) (pubSegs []segment, scratch segment, err error) {
+// findSegments finds the published segments of the WAL in dir, along with its scratch segment, if
+// any. Unless readOnly is set, a stale scratch segment left behind by a crash is removed.
+func findSegments(
+	dir string,
+	opts *Options,
+	readOnly bool,
+) (pubSegs []segment, scratch segment, err error) {
 	scratch = nonExistingSegment
 
-	publishedPaths, scratchPaths, err := getSegmentPaths(dir)
+	publishedPaths, scratchPaths, err := getSegmentPaths(opts.FS, dir)
 	if err != nil {
 		return pubSegs, scratch, err
 	}
@@ -320,10 +725,10 @@ func findSegments(dir string, sizeHint int) (pubSegs []segment, scratch segment,
 		}
 		maxSeq = seq
 		seg := segment{
-			seq:      seq,
-			ind:      ind,
-			dir:      dir,
-			sizeHint: sizeHint,
+			seq:  seq,
+			ind:  ind,
+			dir:  dir,
+			opts: opts,
 		}
 		pubSegs = append(pubSegs, seg)
 	}
@@ -335,53 +740,86 @@ func findSegments(dir string, sizeHint int) (pubSegs []segment, scratch segment,
 			// subtly ignore error (invalid scratch)
 			return pubSegs, nonExistingSegment, nil
 		}
+		if readOnly && init && seq <= maxSeq {
+			// Either the scratch is stale (see below), or the WAL is being written to, and the
+			// scratch was published in between listing the two directories.
+			return pubSegs, nonExistingSegment, nil
+		}
+		if init && seq == maxSeq && ind == pubSegs[len(pubSegs)-1].ind {
+			// The scratch was published, but we crashed before the removal of its old name from
+			// the scratch directory was synced. The published segment is the real one.
+			if err := opts.FS.Remove(scratchFile); err != nil {
+				return pubSegs, nonExistingSegment, err
+			}
+			return pubSegs, nonExistingSegment, opts.FS.SyncDir(scratchDir(dir))
+		}
 		if init && seq != maxSeq+1 {
 			return pubSegs, nonExistingSegment, fmt.Errorf(
 				"data corruption: outstanding scratch seq must be 1+ largest: got %d", seq)
 		}
 		maxSeq = seq
 		scratch = segment{
-			seq:      seq,
-			ind:      ind,
-			dir:      dir,
-			sizeHint: sizeHint,
+			seq:  seq,
+			ind:  ind,
+			dir:  dir,
+			opts: opts,
 		}
 	}
 	return pubSegs, scratch, nil
 }
 
-func getSegmentPaths(dir string) (published, scratches []string, err error) {
-	walkFunc := func(paths *[]string) filepath.WalkFunc {
-		init := false
-		return func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if info.IsDir() {
-				if !init {
-					init = true
-					return nil
-				}
-				return filepath.SkipDir
-			}
-			if filepath.Ext(path) == SegExt {
-				*paths = append(*paths, path)
-			}
-			return nil
+// readTimeRanges fills in the time ranges of the published segments pubSegs from their footers.
+// Those of segments in known, as of an earlier call, are taken from there instead of being read
+// again. A segment whose footer is corrupt is given an unbounded time range, so that SeekTime
+// reads it, and reports the corruption, rather than skip it. I/O errors are returned.
+func readTimeRanges(pubSegs, known []segment, reuseReader func(io.Reader) *bufio.Reader) error {
+	for i := range pubSegs {
+		seg := &pubSegs[i]
+		j := sort.Search(len(known), func(j int) bool { return known[j].seq >= seg.seq })
+		if j < len(known) && known[j].seq == seg.seq && known[j].ind == seg.ind {
+			seg.minTime, seg.maxTime = known[j].minTime, known[j].maxTime
+			continue
+		}
+		sr, err := seg.openPublished(reuseReader)
+		if os.IsNotExist(err) {
+			// deleted since the segments were listed, by the writer of a read-only WAL
+			continue
+		} else if _, ok := err.(*os.PathError); ok {
+			return err
+		} else if err != nil {
+			seg.minTime, seg.maxTime = time.Time{}, time.Unix(1<<62, 0) // far beyond any record
+			continue
+		}
+		if sr.footer != nil {
+			seg.minTime, seg.maxTime = sr.footer.minTime, sr.footer.maxTime
 		}
+		sr.Close()
 	}
+	return nil
+}
 
-	if _, err2 := os.Stat(dir); !os.IsNotExist(err2) {
-		if err = filepath.Walk(dir, walkFunc(&published)); err != nil {
-			return
+func getSegmentPaths(fs FS, dir string) (published, scratches []string, err error) {
+	list := func(dir string) ([]string, error) {
+		names, err := fs.List(dir)
+		if os.IsNotExist(err) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
 		}
-	}
-	if _, err2 := os.Stat(scratchDir(dir)); !os.IsNotExist(err2) {
-		if err = filepath.Walk(scratchDir(dir), walkFunc(&scratches)); err != nil {
-			return
+		var paths []string
+		for _, name := range names {
+			if filepath.Ext(name) == SegExt {
+				paths = append(paths, filepath.Join(dir, name))
+			}
 		}
+		return paths, nil
+	}
+
+	// List the scratch directory first. That way, if the WAL is being written to, a scratch
+	// segment that is published in the meantime is listed twice, rather than not at all.
+	if scratches, err = list(scratchDir(dir)); err != nil {
+		return
 	}
-	sort.Strings(published)
-	sort.Strings(scratches)
+	published, err = list(dir)
 	return
 }
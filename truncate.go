@@ -0,0 +1,234 @@
+package wal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+)
+
+// firstIndexFileName is the name of the file in the WAL directory that records the first index
+// of the WAL, as set by TruncateFront. It holds the index (8 bytes) followed by its checksum
+// (4 bytes).
+const firstIndexFileName = "first-index"
+
+// TruncateFront discards every record preceding index, making index the first index of the WAL.
+// Published segments that only hold discarded records are deleted. index must not exceed
+// LastIndex()+1. The WAL is synced beforehand.
+func (wal *WAL) TruncateFront(index uint64) error {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	if err := wal.writable(); err != nil {
+		return err
+	}
+	if index <= wal.firstIndex() {
+		return nil
+	}
+	if index > wal.lastInd+1 {
+		return ErrOutOfRange
+	}
+
+	// Sync the records up to index first, so that a crash can't leave the WAL ending before its
+	// first index. Then durably record the new first index before deleting anything. That way,
+	// discarded records never resurface, even if we crash part way through.
+	if err := wal.sync(); err != nil {
+		return err
+	}
+	if err := writeFirstIndex(&wal.opts, wal.dir, index); err != nil {
+		return err
+	}
+	wal.firstInd = index
+	wal.cache.truncateFront(index)
+
+	// Delete published segments whose records all precede index, from oldest to newest, so
+	// that the remaining seqs stay contiguous.
+	n := 0
+	for ; n < len(wal.pubSegs); n++ {
+		next := wal.scratchRW.segment.ind
+		if n+1 < len(wal.pubSegs) {
+			next = wal.pubSegs[n+1].ind
+		}
+		if next > index {
+			break
+		}
+		seg := wal.pubSegs[n]
+		if err := wal.opts.FS.Remove(segmentFileName(seg.dir, seg.seq, seg.ind)); err != nil {
+			wal.pubSegs = wal.pubSegs[n:]
+			return err
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	wal.pubSegs = wal.pubSegs[n:]
+	return wal.opts.FS.SyncDir(wal.dir)
+}
+
+// TruncateBack discards every record following index, making index the last index of the WAL.
+// Subsequent writes continue from index+1. The segment holding index becomes the scratch segment
+// (if it isn't already), and later segments are deleted. The truncation is synced to disk, but if
+// it is interrupted by a crash, only some of the records may have been discarded.
+//
+// Iterators that have already returned records following index fail with ErrTruncated from then
+// on. If the truncation fails part way through, the WAL fails, and has to be reopened.
+func (wal *WAL) TruncateBack(index uint64) error {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	if err := wal.writable(); err != nil {
+		return err
+	}
+	if index >= wal.lastInd {
+		return nil
+	}
+	if index+1 < wal.firstIndex() {
+		return ErrCompacted
+	}
+	atomic.AddUint64(&wal.truncations, 1)
+	wal.cache.truncateBack(index)
+	// The scratch segment shrinks or is replaced, so a postponed cut is off (see postponeCut).
+	wal.cutRetrySize = 0
+	if err := wal.truncateBack(index); err != nil {
+		return wal.fail(err)
+	}
+	// the truncation is synced
+	wal.synced()
+	return nil
+}
+
+func (wal *WAL) truncateBack(index uint64) error {
+	scratch := wal.scratchRW.segment
+	if index+1 >= scratch.ind {
+		// index lies in the scratch segment (or right before it)
+		if err := wal.scratchRW.truncate(index + 1 - scratch.ind); err != nil {
+			return err
+		}
+		wal.lastInd = index
+		return nil
+	}
+
+	// Delete the scratch segment and the published segments following the one holding index,
+	// from newest to oldest, so that the remaining seqs stay contiguous.
+	if err := wal.scratchRW.Close(); err != nil {
+		return err
+	}
+	if err := wal.opts.FS.Remove(segmentFileName(scratchDir(scratch.dir), scratch.seq, scratch.ind)); err != nil {
+		return err
+	}
+	// Sync the removal before deleting any published segment: if we crash in between, a scratch
+	// segment that outlives the segments preceding it can't be recovered.
+	if err := wal.opts.FS.SyncDir(scratchDir(wal.dir)); err != nil {
+		return err
+	}
+	k := sort.Search(len(wal.pubSegs), func(i int) bool {
+		return wal.pubSegs[i].ind > index
+	}) - 1
+	for i := len(wal.pubSegs) - 1; i > k; i-- {
+		seg := wal.pubSegs[i]
+		if err := wal.opts.FS.Remove(segmentFileName(seg.dir, seg.seq, seg.ind)); err != nil {
+			wal.pubSegs = wal.pubSegs[:i+1]
+			return err
+		}
+	}
+	if err := wal.opts.FS.SyncDir(wal.dir); err != nil {
+		return err
+	}
+
+	if k < 0 {
+		// every record is discarded, so start over with a new scratch segment
+		seg := wal.pubSegs[0]
+		wal.pubSegs = wal.pubSegs[:0]
+		srw, err := segment{
+			seq:  seg.seq,
+			ind:  index + 1,
+			dir:  wal.dir,
+			opts: &wal.opts,
+		}.createScratch(wal.reuseScratchReader, wal.reuseScratchWriter)
+		if err != nil {
+			return err
+		}
+		wal.scratchRW = srw
+		wal.lastInd = index
+		return nil
+	}
+
+	// Move the segment holding index back to the scratch directory, and truncate it there.
+	seg := wal.pubSegs[k]
+	wal.pubSegs = wal.pubSegs[:k]
+	if err := wal.opts.FS.Rename(
+		segmentFileName(seg.dir, seg.seq, seg.ind),
+		segmentFileName(scratchDir(seg.dir), seg.seq, seg.ind),
+	); err != nil {
+		return err
+	}
+	// Sync the scratch directory first: if we crash in between, the segment is found in both
+	// directories (and recovery keeps the published one) rather than in neither.
+	if err := wal.opts.FS.SyncDir(scratchDir(wal.dir)); err != nil {
+		return err
+	}
+	if err := wal.opts.FS.SyncDir(wal.dir); err != nil {
+		return err
+	}
+	srw, err := seg.openScratch(wal.reuseScratchReader, wal.reuseScratchWriter)
+	if err != nil {
+		return err
+	}
+	wal.scratchRW = srw
+	if err := wal.scratchRW.truncate(index + 1 - seg.ind); err != nil {
+		return err
+	}
+	wal.lastInd = index
+	return nil
+}
+
+// readFirstIndex reads the first index recorded by TruncateFront. 0 is returned if there is none.
+func readFirstIndex(fs FS, dir string) (uint64, error) {
+	f, err := fs.OpenFile(filepath.Join(dir, firstIndexFileName), os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	b, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return 0, err
+	}
+	if len(b) != 12 || crc32.Checksum(b[:8], crcTable) != binary.LittleEndian.Uint32(b[8:]) {
+		return 0, fmt.Errorf("data corruption: invalid %s file", firstIndexFileName)
+	}
+	return binary.LittleEndian.Uint64(b[:8]), nil
+}
+
+// writeFirstIndex atomically replaces the recorded first index, by writing it to a temporary
+// file and renaming that over the old one.
+func writeFirstIndex(opts *Options, dir string, index uint64) error {
+	var b [12]byte
+	binary.LittleEndian.PutUint64(b[:8], index)
+	binary.LittleEndian.PutUint32(b[8:], crc32.Checksum(b[:8], crcTable))
+
+	name := filepath.Join(dir, firstIndexFileName)
+	f, err := opts.FS.OpenFile(name+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, opts.FileMode)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b[:]); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := opts.FS.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+	return opts.FS.SyncDir(dir)
+}
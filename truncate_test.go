@@ -0,0 +1,256 @@
+package wal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func Test_WAL_TruncateFront(t *testing.T) {
+	// Create a new WAL.
+	baseDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(baseDir)
+	walDir := filepath.Join(baseDir, "wal")
+	wal, err := OpenWAL(walDir, &Options{SegmentSize: testSegmentSize, Logger: zap.NewExample()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for len(wal.pubSegs) < 5 {
+		if _, err := wal.Append([]byte(fmt.Sprintf("%d", wal.LastIndex()+1))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := wal.TruncateFront(wal.LastIndex() + 2); err != ErrOutOfRange {
+		t.Fatalf("expected ErrOutOfRange, but got %v", err)
+	}
+
+	// Truncate in the middle of the 3rd segment.
+	index := wal.pubSegs[2].ind + 1
+	if err := wal.TruncateFront(index); err != nil {
+		t.Fatal(err)
+	}
+	if len(wal.pubSegs) != 3 || wal.pubSegs[0].seq != 2 {
+		t.Fatalf("expected the first 2 segments to be deleted, but got %v", wal.pubSegs)
+	}
+	expectFirst := func(wal *WAL, index uint64) {
+		t.Helper()
+		if wal.FirstIndex() != index {
+			t.Fatalf("expected first index to be %d, but got %d", index, wal.FirstIndex())
+		}
+		if _, err := wal.ReadFrom(index - 1); err != ErrCompacted {
+			t.Fatalf("expected ErrCompacted, but got %v", err)
+		}
+		want := index
+		if err := wal.Visit(func(data []byte) error {
+			if string(data) != fmt.Sprintf("%d", want) {
+				return fmt.Errorf("expected %d, but got %s", want, data)
+			}
+			want++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if want != wal.LastIndex()+1 {
+			t.Fatalf("visited up to %d, but expected to visit up to %d", want-1, wal.LastIndex())
+		}
+	}
+	expectFirst(wal, index)
+
+	// The first index survives reopening.
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wal, err = OpenWAL(walDir, &Options{SegmentSize: testSegmentSize, Logger: zap.NewExample()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectFirst(wal, index)
+
+	// Truncate everything.
+	lastInd := wal.LastIndex()
+	if err := wal.TruncateFront(lastInd + 1); err != nil {
+		t.Fatal(err)
+	}
+	if len(wal.pubSegs) != 0 {
+		t.Fatalf("expected every published segment to be deleted, but got %v", wal.pubSegs)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wal, err = OpenWAL(walDir, &Options{SegmentSize: testSegmentSize, Logger: zap.NewExample()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	if wal.FirstIndex() != lastInd+1 || wal.LastIndex() != lastInd {
+		t.Fatalf("expected the WAL to span [%d, %d], but got [%d, %d]",
+			lastInd+1, lastInd, wal.FirstIndex(), wal.LastIndex())
+	}
+	if ind, err := wal.Append([]byte(fmt.Sprintf("%d", lastInd+1))); err != nil {
+		t.Fatal(err)
+	} else if ind != lastInd+1 {
+		t.Fatalf("expected index %d, but got %d", lastInd+1, ind)
+	}
+	expectFirst(wal, lastInd+1)
+}
+
+// Test_WAL_TruncateFront_Iterator truncates every published segment while an iterator is reading
+// one of them.
+func Test_WAL_TruncateFront_Iterator(t *testing.T) {
+	fs := NewMemFS()
+	wal, err := OpenWAL("wal", &Options{SegmentSize: testSegmentSize, FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	for len(wal.pubSegs) < 2 {
+		if _, err := wal.Append([]byte(fmt.Sprintf("%d", wal.LastIndex()+1))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	it, err := wal.ReadFrom(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	if _, _, err := it.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.TruncateFront(wal.LastIndex() + 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// The iterator finishes the segment it has open, but can't skip over the next one.
+	for {
+		_, _, err := it.Next()
+		if err == ErrCompacted {
+			break
+		}
+		if err != nil {
+			t.Fatalf("expected ErrCompacted, but got %v", err)
+		}
+	}
+}
+
+func Test_WAL_TruncateBack(t *testing.T) {
+	// Create a new WAL.
+	baseDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(baseDir)
+	walDir := filepath.Join(baseDir, "wal")
+	wal, err := OpenWAL(walDir, &Options{SegmentSize: testSegmentSize, Logger: zap.NewExample()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		wal.Close()
+	}()
+
+	// appendUntil appends records whose data is their index, until there are n published segments.
+	appendUntil := func(n int) {
+		t.Helper()
+		for len(wal.pubSegs) < n {
+			if _, err := wal.Append([]byte(fmt.Sprintf("%d", wal.LastIndex()+1))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// expectLast checks that the WAL consists of the records [1, index], then appends one more
+	// record, both before and after reopening the WAL.
+	expectLast := func(index uint64) {
+		t.Helper()
+		for reopen := 0; reopen < 2; reopen++ {
+			if reopen > 0 {
+				if err := wal.Close(); err != nil {
+					t.Fatal(err)
+				}
+				if wal, err = OpenWAL(walDir, &Options{SegmentSize: testSegmentSize, Logger: zap.NewExample()}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if wal.LastIndex() != index {
+				t.Fatalf("expected last index to be %d, but got %d", index, wal.LastIndex())
+			}
+			want := wal.FirstIndex()
+			if err := wal.Visit(func(data []byte) error {
+				if string(data) != fmt.Sprintf("%d", want) {
+					return fmt.Errorf("expected %d, but got %s", want, data)
+				}
+				want++
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if want != index+1 {
+				t.Fatalf("visited up to %d, but expected to visit up to %d", want-1, index)
+			}
+			if ind, err := wal.Append([]byte(fmt.Sprintf("%d", index+1))); err != nil {
+				t.Fatal(err)
+			} else if ind != index+1 {
+				t.Fatalf("expected to append at %d, but got %d", index+1, ind)
+			}
+			index++
+		}
+	}
+
+	// Truncate within the scratch segment.
+	appendUntil(1)
+	for i := 0; i < 3; i++ {
+		if _, err := wal.Append([]byte(fmt.Sprintf("%d", wal.LastIndex()+1))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index := wal.LastIndex() - 2
+	if err := wal.TruncateBack(index); err != nil {
+		t.Fatal(err)
+	}
+	expectLast(index)
+
+	// Truncate within a published segment.
+	appendUntil(5)
+	index = wal.pubSegs[2].ind + 1
+	if err := wal.TruncateBack(index); err != nil {
+		t.Fatal(err)
+	}
+	if len(wal.pubSegs) != 2 || wal.scratchRW.segment.seq != 2 {
+		t.Fatalf("expected the 3rd segment to become the scratch, but got %v and %v", wal.pubSegs, wal.scratchRW.segment)
+	}
+	expectLast(index)
+
+	// Truncate within a batch.
+	var b Batch
+	for i := uint64(1); i <= 3; i++ {
+		b.Add([]byte(fmt.Sprintf("%d", wal.LastIndex()+i)))
+	}
+	first, err := wal.WriteBatch(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.TruncateBack(first); err != nil {
+		t.Fatal(err)
+	}
+	expectLast(first)
+
+	// Truncate everything.
+	if err := wal.TruncateFront(wal.pubSegs[1].ind); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.TruncateBack(wal.FirstIndex() - 2); err != ErrCompacted {
+		t.Fatalf("expected ErrCompacted, but got %v", err)
+	}
+	index = wal.FirstIndex() - 1
+	if err := wal.TruncateBack(index); err != nil {
+		t.Fatal(err)
+	}
+	expectLast(index)
+}
@@ -25,8 +25,8 @@
 //  asynchronously write to disk (i.e. choose when to flush the dirty page back
 //  to disk).
 //
-// WAL is agnostic and lets the user decide which strategy is appropriate: call Write() and
-// Sync() as one pleases.
+// WAL lets the user decide which strategy is appropriate: either call Write() and Sync() as one
+// pleases, or pick a SyncPolicy in the Options given to OpenWAL.
 //
 // Often we want to fetch all written records from an index onwards. To optimize this search
 // pattern, WAL writes records to "segment" files that live in a "WAL" directory. Each segment has
@@ -38,55 +38,136 @@ package wal
 
 import (
 	"bufio"
+	"context"
+	"fmt"
 	"io"
+	"math"
 	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"go.uber.org/zap"
 )
 
-// WAL is a write-ahead-log.
+var (
+	// ErrCompacted is returned when reading from an index that precedes the first index of the WAL.
+	ErrCompacted = fmt.Errorf("requested index precedes the first index of the WAL")
+
+	// ErrOutOfRange is returned when an index lies beyond the last index of the WAL.
+	ErrOutOfRange = fmt.Errorf("requested index is beyond the last index of the WAL")
+
+	// ErrClosed is returned when using a WAL that has been closed.
+	ErrClosed = fmt.Errorf("WAL is closed")
+
+	// ErrLocked is returned by OpenWAL when the WAL is already open, in this process or another.
+	ErrLocked = fmt.Errorf("WAL directory is already locked")
+
+	// ErrReadOnly is returned when writing to, syncing, or truncating a WAL opened with
+	// OpenReadOnly.
+	ErrReadOnly = fmt.Errorf("WAL is read-only")
+
+	// ErrTruncated is returned by an Iterator once records it has returned are discarded by
+	// TruncateBack, of the WAL or of the writer of a read-only WAL.
+	ErrTruncated = fmt.Errorf("records read by the iterator have been discarded by TruncateBack")
+)
+
+// lockFileName is the name of the file in the WAL directory that is locked for as long as the WAL
+// is open.
+const lockFileName = "LOCK"
+
+// WAL is a write-ahead-log. It is safe for concurrent use: writes are serialized, and any
+// number of Iterators may read from the WAL at the same time, each with its own read buffer.
+//
+// If an I/O error leaves the scratch segment in an unknown state (a write cut short, a failed
+// flush or fsync, a new segment that couldn't be created), the WAL fails: the first such error is
+// latched, and from then on returned by writes, syncs and Err, while reads keep working on what
+// made it to the segment. Reopen the WAL to recover. A segment that can't be renamed into the WAL
+// directory on a cut is the exception: it stays the scratch segment, and the cut is retried once
+// another SegmentSize worth of records has been written to it.
 type WAL struct {
+	// truncations counts the TruncateBacks that have discarded records, for Iterators to tell
+	// whether the records they have read are still there. For a read-only WAL, it counts those of
+	// the writer that refresh notices. It is only changed under mu, but Iterators load it
+	// atomically, without taking mu; being the first field keeps it 64-bit aligned for that.
+	truncations uint64
+
+	// mu guards the fields below it, and serializes writes.
+	mu sync.Mutex
+
 	pubSegs   []segment
 	scratchRW *segmentReadWriter
 
-	// TODO(ulysseses): replace with a limited pool of readers/writers (for potential parallel access)
-	brPub     *bufio.Reader
+	// brScratch and bwScratch are reused by every scratch segment. Readers use their own.
 	brScratch *bufio.Reader
 	bwScratch *bufio.Writer
 
 	// dir: move segments from the scratch dir to dir
 	dir string
-	// sizeHint is an indication of how large the segment file can get (in bytes)
-	sizeHint int
 
-	lastInd uint64
+	// firstInd is the first index set by TruncateFront. Records preceding it may still linger in
+	// the first published segment.
+	firstInd uint64
+	lastInd  uint64
+	// durableInd is the index of the last record known to be on disk: as of the last sync (or
+	// publish, which syncs too).
+	durableInd uint64
+
+	opts Options
+	// unsynced is the number of records written since the last sync.
+	unsynced int
+	// cutRetrySize is the size the scratch segment has to reach before a cut is retried, after it
+	// failed to be renamed into the WAL directory. It is 0 otherwise.
+	cutRetrySize int
+	// failed is the latched error that failed the WAL, if any (see WAL).
+	failed error
+	// dirLock is the lock on the LOCK file, held until Close. It is nil if a read-only WAL
+	// couldn't take it.
+	dirLock io.Closer
+	// closed is set by Close. From then on, writes, syncs and truncations fail with ErrClosed.
+	closed bool
+	// readOnly is set if the WAL was opened with OpenReadOnly. Then, scratchRW only reads the
+	// scratch segment (if it exists), and is positioned right after its last intact frame, which
+	// is where both flushed and synced are.
+	readOnly bool
+	// notifyC is closed (and cleared) once new records are written or synced, waking up
+	// Iterator.NextWait. It is only made when there is someone to wake up.
+	notifyC chan struct{}
+
+	// cache holds the records most recently read by Read and ReadRange.
+	cache *readCache
 
 	logger *zap.Logger
+
+	// commitC hands AppendSync requests over to commitLoop.
+	commitC chan *commitRequest
+
+	// closeC is closed by Close to stop background goroutines, which are tracked by wg.
+	closeC    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
 }
 
-func (wal *WAL) reusePubReader(f *os.File) *bufio.Reader {
-	if wal.brPub == nil {
-		wal.brPub = bufio.NewReaderSize(f, wal.sizeHint)
-	} else {
-		wal.brPub.Reset(f)
-	}
-	return wal.brPub
+func (wal *WAL) newPubReader(r io.Reader) *bufio.Reader {
+	return bufio.NewReaderSize(r, wal.opts.ReadBufferSize)
 }
 
-func (wal *WAL) reuseScratchReader(f *os.File) *bufio.Reader {
+func (wal *WAL) reuseScratchReader(r io.Reader) *bufio.Reader {
 	if wal.brScratch == nil {
-		wal.brScratch = bufio.NewReaderSize(f, wal.sizeHint)
+		wal.brScratch = bufio.NewReaderSize(r, wal.opts.ReadBufferSize)
 	} else {
-		wal.brScratch.Reset(f)
+		wal.brScratch.Reset(r)
 	}
 	return wal.brScratch
 }
 
-func (wal *WAL) reuseScratchWriter(f *os.File) *bufio.Writer {
+func (wal *WAL) reuseScratchWriter(w io.Writer) *bufio.Writer {
 	if wal.bwScratch == nil {
-		wal.bwScratch = bufio.NewWriterSize(f, wal.sizeHint)
+		wal.bwScratch = bufio.NewWriterSize(w, wal.opts.WriteBufferSize)
 	} else {
-		wal.bwScratch.Reset(f)
+		wal.bwScratch.Reset(w)
 	}
 	return wal.bwScratch
 }
@@ -94,151 +175,770 @@ func (wal *WAL) reuseScratchWriter(f *os.File) *bufio.Writer {
 // Write to the current segment file, cutting off and starting a new one if necessary.
 // To persist on disk, make sure to call Sync at some point.
 func (wal *WAL) Write(data []byte) (n int, err error) {
-	n, err = wal.scratchRW.frame(data)
-	if err == errSegmentSizeReached {
-		err = wal.cut()
-	}
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	n, _, err = wal.append(&Record{Data: data})
 	if err == nil {
-		wal.lastInd++ // keep lastInd up to date
+		err = wal.applySyncPolicy()
 	}
 	return
 }
 
+// Append is like Write, but returns the index assigned to the record instead of the number of
+// bytes written. Indices are contiguous: the first record of a new WAL has index 1, and each
+// subsequent record has the index of its predecessor plus one.
+func (wal *WAL) Append(data []byte) (uint64, error) {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	_, ind, err := wal.append(&Record{Data: data})
+	if err == nil {
+		err = wal.applySyncPolicy()
+	}
+	return ind, err
+}
+
+// AppendRecord is like Append, but writes the record along with its metadata (see Record). If
+// rec.Time is zero, it is set to the current time.
+func (wal *WAL) AppendRecord(rec Record) (uint64, error) {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	_, ind, err := wal.append(&rec)
+	if err == nil {
+		err = wal.applySyncPolicy()
+	}
+	return ind, err
+}
+
+// append writes the record, stamped with the current time unless it already has a time.
+func (wal *WAL) append(rec *Record) (n int, ind uint64, err error) {
+	if err := wal.writable(); err != nil {
+		return 0, 0, err
+	}
+	rec.stamp()
+	n, err = wal.scratchRW.frame(rec)
+	if err != nil && err != errSegmentSizeReached {
+		// The frame may have been partially written.
+		return n, 0, wal.fail(err)
+	}
+	wal.lastInd++ // keep lastInd up to date
+	wal.unsynced++
+	wal.notify()
+	ind = wal.lastInd
+	if err == errSegmentSizeReached {
+		err = wal.cut()
+	}
+	return n, ind, err
+}
+
 // writeNoCut writes, but does not perform any auto-cutting procedure.
 func (wal *WAL) writeNoCut(data []byte) (n int, err error) {
-	n, err = wal.scratchRW.frame(data)
-	if err == nil {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	rec := Record{Data: data}
+	rec.stamp()
+	n, err = wal.scratchRW.frame(&rec)
+	if err == nil || err == errSegmentSizeReached {
 		wal.lastInd++ // keep lastInd up to date
+		wal.unsynced++
 	}
 	return
 }
 
+// FirstIndex returns the index of the first record in the WAL.
+func (wal *WAL) FirstIndex() uint64 {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	return wal.firstIndex()
+}
+
+// LastIndex returns the index of the last record written to the WAL. If the WAL is empty, this
+// is FirstIndex() - 1.
+func (wal *WAL) LastIndex() uint64 {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	return wal.lastInd
+}
+
 // Sync persists accumulated writes from both the user-land buffer and kernel page cache to disk.
 func (wal *WAL) Sync() error {
-	return wal.scratchRW.sync()
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	return wal.sync()
+}
+
+func (wal *WAL) sync() error {
+	if err := wal.writable(); err != nil {
+		return err
+	}
+	if err := wal.scratchRW.sync(); err != nil {
+		// After a failed fsync, the kernel may have dropped the dirty pages, so retrying could
+		// report success even though the writes never made it to disk.
+		return wal.fail(err)
+	}
+	wal.synced()
+	return nil
+}
+
+// synced records that every record written so far is on disk.
+func (wal *WAL) synced() {
+	wal.unsynced = 0
+	wal.durableInd = wal.lastInd
+	wal.notify()
+}
+
+// DurableIndex returns the index of the last record that is known to be on disk, i.e. that has
+// been synced. Records up to it survive a crash.
+func (wal *WAL) DurableIndex() uint64 {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	return wal.durableInd
+}
+
+// WaitDurable waits until the record at index is on disk, so that it can be acknowledged, say.
+// It doesn't sync by itself: records are synced as the SyncPolicy calls for, or by a Sync (or
+// AppendSync) elsewhere. It returns ctx.Err() if ctx is done first, ErrClosed if the WAL is
+// closed, and the error that failed the WAL if it fails, since the record may then never make it
+// to disk.
+func (wal *WAL) WaitDurable(ctx context.Context, index uint64) error {
+	for {
+		// get notified of syncs from here on, so that none slip by in between
+		notifyC := wal.notifyChan()
+		wal.mu.Lock()
+		durableInd, failed := wal.durableInd, wal.failed
+		wal.mu.Unlock()
+		if durableInd >= index {
+			return nil
+		}
+		if failed != nil {
+			return failed
+		}
+		if err := wal.wait(ctx, notifyC); err != nil {
+			return err
+		}
+	}
+}
+
+// notify wakes up iterators waiting for new records.
+func (wal *WAL) notify() {
+	if wal.notifyC != nil {
+		close(wal.notifyC)
+		wal.notifyC = nil
+	}
+}
+
+// wait waits until records may have been written (or synced) since notifyC was obtained from
+// notifyChan, or until ctx is done. A read-only WAL is refreshed every Options.PollInterval
+// instead, since it is written to by someone else.
+func (wal *WAL) wait(ctx context.Context, notifyC <-chan struct{}) error {
+	var pollC <-chan time.Time
+	if wal.readOnly {
+		timer := time.NewTimer(wal.opts.PollInterval)
+		defer timer.Stop()
+		pollC = timer.C
+	}
+	select {
+	case <-notifyC:
+		return nil
+	case <-pollC:
+		wal.mu.Lock()
+		defer wal.mu.Unlock()
+		select {
+		case <-wal.closeC:
+			return ErrClosed
+		default:
+		}
+		return wal.refresh()
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-wal.closeC:
+		return ErrClosed
+	}
 }
 
-// Close closes the WAL. This does NOT sync, so remember to call WAL.Sync()
+// notifyChan returns the channel that the next notify closes.
+func (wal *WAL) notifyChan() <-chan struct{} {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	if wal.notifyC == nil {
+		wal.notifyC = make(chan struct{})
+	}
+	return wal.notifyC
+}
+
+// Err returns the first error that failed the WAL, or nil if it hasn't failed. Once it is
+// non-nil, every write and sync fails with it, since retrying could report success for writes
+// that never made it to disk: after a failed fsync, the kernel may have dropped the dirty pages.
+// The only way to recover is to close the WAL and reopen it, which recovers from what is on disk.
+func (wal *WAL) Err() error {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	return wal.failed
+}
+
+// fail puts the WAL in the failed state, unless it is already in it, and returns err.
+func (wal *WAL) fail(err error) error {
+	if wal.failed == nil {
+		wal.failed = err
+		wal.notify()
+		if wal.logger != nil {
+			wal.logger.Error("WAL failed; writes and syncs are refused from now on", zap.Error(err))
+		}
+	}
+	return err
+}
+
+// writable returns the error that writes fail with, if any: ErrClosed if the WAL is closed,
+// ErrReadOnly if it is read-only, or else the error that failed it.
+func (wal *WAL) writable() error {
+	if wal.closed {
+		return ErrClosed
+	}
+	if wal.readOnly {
+		return ErrReadOnly
+	}
+	return wal.failed
+}
+
+// applySyncPolicy syncs if the SyncPolicy calls for it after a write.
+func (wal *WAL) applySyncPolicy() error {
+	switch wal.opts.SyncPolicy {
+	case SyncAlways:
+		return wal.sync()
+	case SyncEveryN:
+		if wal.unsynced >= wal.opts.SyncBatchSize {
+			return wal.sync()
+		}
+	}
+	return nil
+}
+
+// syncLoop syncs every Options.SyncInterval (if anything has been written since the last sync),
+// until the WAL is closed.
+func (wal *WAL) syncLoop() {
+	defer wal.wg.Done()
+	ticker := time.NewTicker(wal.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-wal.closeC:
+			return
+		}
+		wal.mu.Lock()
+		var err error
+		if wal.unsynced > 0 && wal.failed == nil {
+			err = wal.sync()
+		}
+		wal.mu.Unlock()
+		if err != nil && wal.logger != nil {
+			wal.logger.Error("failed to sync", zap.Error(err))
+		}
+	}
+}
+
+// Close closes the WAL. Unless the SyncPolicy is SyncNever, it syncs first. Otherwise, this does
+// NOT sync, so remember to call WAL.Sync(). If the WAL has failed, Close returns the error that
+// failed it.
 func (wal *WAL) Close() error {
-	return wal.scratchRW.Close()
+	// stop background goroutines first, since they may need the lock to finish up
+	err := ErrClosed
+	wal.closeOnce.Do(func() {
+		close(wal.closeC)
+		err = nil
+	})
+	if err != nil {
+		return err
+	}
+	wal.wg.Wait()
+
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	if wal.dirLock != nil {
+		defer wal.dirLock.Close()
+	}
+	// once the final sync (if any) is done
+	defer func() { wal.closed = true }()
+	if wal.readOnly {
+		if wal.scratchRW.f == nil {
+			return nil
+		}
+		return wal.scratchRW.segmentReader.Close()
+	}
+	if wal.failed != nil {
+		// release the scratch segment, but report what failed
+		wal.scratchRW.Close()
+		return wal.failed
+	}
+	if wal.opts.SyncPolicy != SyncNever {
+		err = wal.sync()
+	}
+	if closeErr := wal.scratchRW.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
 
 // cut will sync and close the segment file, then create a new one for the next write.
+//
+// If the segment can't be renamed into the WAL directory, it is kept as the scratch segment (see
+// postponeCut). Any other error fails the WAL.
 func (wal *WAL) cut() error {
+	if wal.scratchRW.size() < wal.cutRetrySize {
+		return nil
+	}
+
 	// publish scratch
 	seg, err := wal.scratchRW.publish()
-	if err != nil {
-		return err
+	if _, ok := err.(errorRename); ok {
+		wal.postponeCut(err)
+		return nil
+	} else if err != nil {
+		return wal.fail(err)
 	}
 	wal.pubSegs = append(wal.pubSegs, seg)
+	wal.cutRetrySize = 0
+	wal.synced() // publishing syncs
 
 	// start a new segment
-	wal.scratchRW, err = segment{
-		seq:      seg.seq + 1,
-		ind:      wal.lastInd + 1,
-		dir:      wal.dir,
-		sizeHint: wal.sizeHint,
+	scratchRW, err := segment{
+		seq:  seg.seq + 1,
+		ind:  wal.lastInd + 1,
+		dir:  wal.dir,
+		opts: &wal.opts,
 	}.createScratch(wal.reuseScratchReader, wal.reuseScratchWriter)
 	if err != nil {
-		return err
+		return wal.fail(err)
 	}
+	wal.scratchRW = scratchRW
 
 	return nil
 }
 
+// postponeCut keeps the scratch segment after it failed to be renamed into the WAL directory, and
+// holds off on cutting it again until another SegmentSize worth of records has been written to it.
+// Each attempt seals and syncs the segment, which would otherwise be repeated on every write for as
+// long as the rename keeps failing.
+func (wal *WAL) postponeCut(err error) {
+	wal.cutRetrySize = wal.scratchRW.size() + wal.opts.SegmentSize
+	if wal.logger != nil {
+		wal.logger.Warn("failed to cut segment; retrying once it grows by another segment size", zap.Error(err))
+	}
+}
+
 // Visit visits every frame (published or scratch), deframes it, and applies f to it.
 func (wal *WAL) Visit(f func(data []byte) error) error {
-	// visit published segments
-	for _, seg := range wal.pubSegs {
-		segR, err := seg.openPublished(wal.reusePubReader)
+	return wal.VisitRecords(func(rec Record) error {
+		return f(rec.Data)
+	})
+}
+
+// VisitRecords is like Visit, but applies f to every record along with its metadata.
+func (wal *WAL) VisitRecords(f func(rec Record) error) error {
+	it, err := wal.ReadFrom(wal.FirstIndex())
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	for {
+		rec, err := it.NextRecord()
+		if err == io.EOF {
+			return nil
+		}
 		if err != nil {
 			return err
 		}
-		for {
-			data, _, err := segR.deframe()
-			if err == io.EOF {
-				segR.Close()
-				break
-			}
-			if err != nil {
-				segR.Close()
-				return err
-			}
-			if err := f(data); err != nil {
-				segR.Close()
-				return err
-			}
+		if err := f(rec); err != nil {
+			return err
 		}
 	}
+}
 
-	return nil
+// ReadFrom returns an Iterator that yields every written record from index onwards, including
+// those in the scratch segment that have not been synced yet. Rather than replaying the WAL from
+// the beginning, it binary searches the published segments for the one that contains index, and
+// looks up the offset of the record in the footer of that segment, or in the index kept of the
+// scratch segment. (Segments written before headers and footers were introduced are deframed from
+// their start instead.)
+func (wal *WAL) ReadFrom(index uint64) (*Iterator, error) {
+	return wal.readFrom(index, false)
 }
 
-// OpenWAL opens the directory and finds all existing segment files.
-func OpenWAL(dir string, sizeHint int, logger *zap.Logger) (*WAL, error) {
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		if err := os.Mkdir(dir, privateDirMode); err != nil {
+// ReadSyncedFrom is like ReadFrom, except that the Iterator only yields records that have been
+// synced to disk.
+func (wal *WAL) ReadSyncedFrom(index uint64) (*Iterator, error) {
+	return wal.readFrom(index, true)
+}
+
+func (wal *WAL) readFrom(index uint64, synced bool) (*Iterator, error) {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	if index < wal.firstIndex() {
+		return nil, ErrCompacted
+	}
+	it := Iterator{
+		wal:         wal,
+		synced:      synced,
+		seq:         wal.scratchRW.segment.seq,
+		ind:         index,
+		seeking:     true,
+		last:        -1,
+		truncations: wal.truncations,
+	}
+	// find the last published segment that begins at or before index
+	i := sort.Search(len(wal.pubSegs), func(i int) bool {
+		return wal.pubSegs[i].ind > index
+	})
+	if i > 0 {
+		it.seq = wal.pubSegs[i-1].seq
+	}
+	return &it, nil
+}
+
+// firstIndex is the index of the first record in the WAL.
+func (wal *WAL) firstIndex() uint64 {
+	first := wal.scratchRW.segment.ind
+	if len(wal.pubSegs) > 0 {
+		first = wal.pubSegs[0].ind
+	}
+	if wal.firstInd > first {
+		return wal.firstInd
+	}
+	return first
+}
+
+// openSegment opens the segment with the given seq for reading. If it is the scratch segment,
+// reads are bounded to what has been flushed (or synced, if synced is set). io.EOF is returned if
+// no such segment exists (yet).
+func (wal *WAL) openSegment(
+	seq uint64,
+	synced bool,
+	reuseReader func(io.Reader) *bufio.Reader,
+) (*segmentReader, error) {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	if seg, ok := wal.publishedSegment(seq); ok {
+		segR, err := seg.openPublished(reuseReader)
+		if wal.readOnly && os.IsNotExist(err) {
+			// the writer has truncated the WAL since
+			return nil, ErrCompacted
+		}
+		return segR, err
+	}
+	if seq < wal.scratchRW.segment.seq {
+		// seqs are contiguous, so the segment has been deleted by TruncateFront, even if no
+		// published segment is left
+		return nil, ErrCompacted
+	}
+	if seq != wal.scratchRW.segment.seq {
+		return nil, io.EOF
+	}
+	limit, err := wal.scratchLimit(synced)
+	if err != nil {
+		return nil, err
+	}
+	if wal.readOnly {
+		if limit == 0 {
+			// there is nothing to read, and the segment may not even exist
+			return nil, io.EOF
+		}
+		return wal.scratchRW.segment.openReadOnlyScratch(limit, reuseReader)
+	}
+	return wal.scratchRW.segment.openScratchReader(limit, reuseReader)
+}
+
+// readLimit returns how many bytes of the segment with the given seq may be read, by a reader
+// that opened it while it was the scratch segment. If it has been published since, it may be read
+// through to the end, which is reported by published.
+func (wal *WAL) readLimit(seq uint64, synced bool) (limit int64, published bool, err error) {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	if seq != wal.scratchRW.segment.seq {
+		return 0, true, nil
+	}
+	limit, err = wal.scratchLimit(synced)
+	return limit, false, err
+}
+
+// truncatedBack returns the number of TruncateBacks that have discarded records so far, along with
+// the last index.
+func (wal *WAL) truncatedBack() (truncations, lastInd uint64) {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	return wal.truncations, wal.lastInd
+}
+
+// scratchLimit returns how many bytes of the scratch segment may be read. Unless only synced
+// frames are wanted, buffered frames are flushed first so that they become visible.
+func (wal *WAL) scratchLimit(synced bool) (int64, error) {
+	if synced {
+		return wal.scratchRW.synced, nil
+	}
+	if wal.failed != nil || wal.readOnly {
+		// only what made it to the segment
+		return wal.scratchRW.flushed, nil
+	}
+	if err := wal.scratchRW.flush(); err != nil {
+		return 0, wal.fail(err)
+	}
+	return wal.scratchRW.flushed, nil
+}
+
+// scratchOffset looks up the offset of the frame of the record with the given index in the
+// scratch segment, along with the offset of the frame before it (-1 if there is none). ok is false
+// if the scratch segment doesn't have the given seq. If the record hasn't been written yet, the
+// offset is math.MaxInt64.
+func (wal *WAL) scratchOffset(seq, ind uint64) (offset, prev int64, ok bool) {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	srw := wal.scratchRW
+	if seq != srw.segment.seq {
+		return 0, 0, false
+	}
+	i := ind - srw.segment.ind
+	if ind > wal.lastInd || i >= uint64(len(srw.offsets)) {
+		return math.MaxInt64, 0, true
+	}
+	prev = -1
+	if i > 0 {
+		prev = srw.offsets[i-1]
+	}
+	return srw.offsets[i], prev, true
+}
+
+// publishedSegment looks up the published segment with the given seq.
+func (wal *WAL) publishedSegment(seq uint64) (segment, bool) {
+	if len(wal.pubSegs) == 0 || seq < wal.pubSegs[0].seq {
+		return segment{}, false
+	}
+	i := seq - wal.pubSegs[0].seq
+	if i >= uint64(len(wal.pubSegs)) {
+		return segment{}, false
+	}
+	return wal.pubSegs[i], true
+}
+
+// OpenWAL opens the directory and finds all existing segment files. opts may be nil, in which
+// case the defaults are used. The WAL directory is locked until Close; if it is already locked,
+// ErrLocked is returned.
+func OpenWAL(dir string, opts *Options) (_ *WAL, err error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	wal := WAL{
+		dir:    dir,
+		logger: opts.Logger,
+		opts:   opts.withDefaults(),
+	}
+	wal.cache = newReadCache(wal.opts.ReadCacheSize)
+	logger := wal.logger
+	fs := wal.opts.FS
+
+	created := false
+	if _, err := fs.Stat(dir); os.IsNotExist(err) {
+		if err := fs.Mkdir(dir, wal.opts.DirMode); err != nil {
 			return nil, err
 		}
+		created = true
 		if logger != nil {
 			logger.Info("created WAL directory", zap.String("dir", dir))
 		}
 	}
-	if _, err := os.Stat(scratchDir(dir)); os.IsNotExist(err) {
-		if err := os.Mkdir(scratchDir(dir), privateDirMode); err != nil {
+	if _, err := fs.Stat(scratchDir(dir)); os.IsNotExist(err) {
+		if err := fs.Mkdir(scratchDir(dir), wal.opts.DirMode); err != nil {
 			return nil, err
 		}
+		created = true
 		if logger != nil {
 			logger.Info("created WAL scratch directory", zap.String("dir", scratchDir(dir)))
 		}
 	}
+	if created {
+		// Make sure the new directories survive a crash.
+		if err := fs.SyncDir(filepath.Dir(filepath.Clean(dir))); err != nil {
+			return nil, err
+		}
+	}
 
-	pubSegs, scratch, err := findSegments(dir, sizeHint)
+	// Lock the WAL before touching any segments, since another user may be writing to them.
+	if wal.dirLock, err = lockDir(fs, dir, wal.opts.FileMode); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			wal.dirLock.Close()
+		}
+	}()
+
+	pubSegs, scratch, err := findSegments(dir, &wal.opts, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := readTimeRanges(pubSegs, nil, wal.newPubReader); err != nil {
+		return nil, err
+	}
+	firstInd, err := readFirstIndex(fs, dir)
 	if err != nil {
 		return nil, err
 	}
 
+	wal.pubSegs = pubSegs
+	wal.firstInd = firstInd
+	wal.lastInd = 0 // a new WAL begins at index 1
+	if firstInd > 0 {
+		// even if every segment is gone, continue from where TruncateFront left off
+		wal.lastInd = firstInd - 1
+	}
+
+	if err := wal.initScratch(scratch); err != nil {
+		return nil, err
+	}
+	// Recovery syncs the scratch segment, and published segments were synced when they were
+	// published.
+	wal.durableInd = wal.lastInd
+
+	wal.closeC = make(chan struct{})
+	wal.commitC = make(chan *commitRequest)
+	wal.wg.Add(1)
+	go wal.commitLoop()
+	if wal.opts.SyncPolicy == SyncInterval {
+		wal.wg.Add(1)
+		go wal.syncLoop()
+	}
+
+	return &wal, nil
+}
+
+// OpenReadOnly opens an existing WAL for reading, through the same methods as OpenWAL. It never
+// writes to the WAL directory: the scratch segment is left as it is, and writes, syncs and
+// truncations fail with ErrReadOnly. The WAL is read as it was when it was opened; records written
+// afterwards only become visible through Iterator.NextWait, which polls for them.
+//
+// A shared lock is taken on the WAL directory until Close, so that OpenWAL fails with ErrLocked
+// in the meantime, rather than recovering the WAL while it is being read. If the WAL is already
+// open for writing, it is read all the same: the scratch segment is read up to its last intact
+// frame, and segments that the writer deletes in the meantime can no longer be read.
+// ReadSyncedFrom can't tell which records have been synced by the writer, so it behaves like
+// ReadFrom.
+func OpenReadOnly(dir string, opts *Options) (_ *WAL, err error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
 	wal := WAL{
 		dir:      dir,
-		sizeHint: sizeHint,
-		pubSegs:  pubSegs,
-		logger:   logger,
+		logger:   opts.Logger,
+		opts:     opts.withDefaults(),
+		readOnly: true,
+		closeC:   make(chan struct{}),
+	}
+	wal.cache = newReadCache(wal.opts.ReadCacheSize)
+	fs := wal.opts.FS
+
+	if _, err := fs.Stat(dir); err != nil {
+		return nil, err
+	}
+	wal.dirLock, err = fs.RLock(filepath.Join(dir, lockFileName))
+	if err == ErrLocked {
+		if wal.logger != nil {
+			wal.logger.Info("WAL is open for writing; reading it regardless", zap.String("dir", dir))
+		}
+	} else if err != nil && !os.IsNotExist(err) {
+		// (there is no LOCK file if the WAL has never been opened for writing since they were
+		// introduced)
+		return nil, err
+	}
+	defer func() {
+		if err != nil && wal.dirLock != nil {
+			wal.dirLock.Close()
+		}
+	}()
+
+	pubSegs, scratch, err := findSegments(dir, &wal.opts, true)
+	if err != nil {
+		return nil, err
+	}
+	if err := readTimeRanges(pubSegs, nil, wal.newPubReader); err != nil {
+		return nil, err
+	}
+	firstInd, err := readFirstIndex(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	wal.pubSegs = pubSegs
+	wal.firstInd = firstInd
+	wal.lastInd = 0
+	if firstInd > 0 {
+		wal.lastInd = firstInd - 1
+	}
+
+	if err := wal.initReadOnlyScratch(scratch); err != nil {
+		return nil, err
 	}
+	// (there is no telling what the writer has synced)
+	wal.durableInd = wal.lastInd
+	return &wal, nil
+}
+
+// lockDir locks the LOCK file of the WAL directory, creating it if needed.
+func lockDir(fs FS, dir string, mode os.FileMode) (io.Closer, error) {
+	name := filepath.Join(dir, lockFileName)
+	f, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE, mode)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return fs.Lock(name)
+}
 
+// initScratch sets up the scratch segment to write to. The existing scratch segment, if any, is
+// resumed after its last intact frame, truncating partial frames; it is only published if it has
+// already reached the segment size.
+func (wal *WAL) initScratch(scratch segment) error {
 	if scratch == nonExistingSegment {
 		// Create a new scratch segment.
-		if len(pubSegs) > 0 {
-			lastSegR, err := pubSegs[len(pubSegs)-1].openPublished(wal.reusePubReader)
+		if len(wal.pubSegs) > 0 {
+			lastSegR, err := wal.pubSegs[len(wal.pubSegs)-1].openPublished(wal.newPubReader)
 			if err != nil {
-				return nil, err
+				return err
 			}
 			defer lastSegR.Close()
-			if err := updateLastInd(&wal, lastSegR); err != nil {
-				return nil, err
+			if err := updateLastInd(wal, lastSegR); err != nil {
+				return err
 			}
 
 			wal.scratchRW, err = segment{
-				seq:      lastSegR.segment.seq + 1,
-				ind:      wal.lastInd + 1,
-				dir:      wal.dir,
-				sizeHint: wal.sizeHint,
+				seq:  lastSegR.segment.seq + 1,
+				ind:  wal.lastInd + 1,
+				dir:  wal.dir,
+				opts: &wal.opts,
 			}.createScratch(wal.reuseScratchReader, wal.reuseScratchWriter)
-			return &wal, err
+			return err
 		}
+		var err error
 		wal.scratchRW, err = segment{
-			dir:      wal.dir,
-			sizeHint: wal.sizeHint,
+			ind:  wal.lastInd + 1,
+			dir:  wal.dir,
+			opts: &wal.opts,
 		}.createScratch(wal.reuseScratchReader, wal.reuseScratchWriter)
-		return &wal, err
+		return err
 	}
 
-	// Publish the existing scratch segment, truncating partial frames, if any.
 	oldScratchRW, err := scratch.openScratch(wal.reuseScratchReader, wal.reuseScratchWriter)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	err = updateLastInd(&wal, &oldScratchRW.segmentReader)
+	err = updateLastInd(wal, &oldScratchRW.segmentReader)
 	if _, ok := err.(errorChecksum); ok {
 		// errorChecksum can indicate either of two things:
 		// 1. the scratch segment file was preallocated but unfinished
@@ -248,31 +948,160 @@ func OpenWAL(dir string, sizeHint int, logger *zap.Logger) (*WAL, error) {
 			wal.logger.Warn("checksum error", zap.Error(err))
 		}
 	} else if err != nil {
-		return nil, err
+		oldScratchRW.Close()
+		return err
+	}
+
+	// Truncate partial frames, if any, and resume appending right after the last intact frame.
+	// The rolling checksum picks up from that frame as well.
+	d := oldScratchRW.segmentReader.deframer
+	if err := oldScratchRW.resume(d.nBytes, d.crc); err != nil {
+		oldScratchRW.Close()
+		return err
+	}
+	if oldScratchRW.size() < wal.opts.SegmentSize {
+		wal.scratchRW = oldScratchRW
+		return nil
 	}
 
+	// The existing scratch segment is already full, so publish it. As in cut, a segment that can't
+	// be renamed into the WAL directory stays the scratch segment for now.
 	pubSeg, err := oldScratchRW.publish()
-	if err != nil {
-		return nil, err
+	if _, ok := err.(errorRename); ok {
+		wal.scratchRW = oldScratchRW
+		wal.postponeCut(err)
+		return nil
+	} else if err != nil {
+		oldScratchRW.Close()
+		return err
 	}
 	wal.pubSegs = append(wal.pubSegs, pubSeg)
 
 	// Then create a new scratch segment.
 	newScratchRW, err := segment{
-		seq:      pubSeg.seq + 1,
-		ind:      wal.lastInd + 1,
-		dir:      wal.dir,
-		sizeHint: wal.sizeHint,
+		seq:  pubSeg.seq + 1,
+		ind:  wal.lastInd + 1,
+		dir:  wal.dir,
+		opts: &wal.opts,
 	}.createScratch(wal.reuseScratchReader, wal.reuseScratchWriter)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	wal.scratchRW = newScratchRW
 
-	return &wal, nil
+	return nil
+}
+
+// initReadOnlyScratch finds where the intact frames of the scratch segment end, without modifying
+// it, and keeps it open there for refresh to read on from. Frames past that point may be torn, or
+// still being written by a live writer. If there is no scratch segment, the one that would follow
+// the last published segment is used in its place.
+func (wal *WAL) initReadOnlyScratch(scratch segment) error {
+	if scratch != nonExistingSegment {
+		sr, err := scratch.openReadOnlyScratch(math.MaxInt64, wal.newPubReader)
+		if err != nil {
+			return err
+		}
+		if err := updateLastInd(wal, sr); err != nil {
+			sr.Close()
+			return err
+		}
+		limit := int64(sr.deframer.nBytes)
+		wal.scratchRW = &segmentReadWriter{segmentReader: *sr, flushed: limit, synced: limit}
+		return nil
+	}
+
+	if len(wal.pubSegs) > 0 {
+		lastSegR, err := wal.pubSegs[len(wal.pubSegs)-1].openPublished(wal.newPubReader)
+		if err != nil {
+			return err
+		}
+		defer lastSegR.Close()
+		if err := updateLastInd(wal, lastSegR); err != nil {
+			return err
+		}
+		scratch = segment{
+			seq:  lastSegR.segment.seq + 1,
+			ind:  wal.lastInd + 1,
+			dir:  wal.dir,
+			opts: &wal.opts,
+		}
+	} else {
+		scratch = segment{
+			ind:  wal.lastInd + 1,
+			dir:  wal.dir,
+			opts: &wal.opts,
+		}
+	}
+
+	wal.scratchRW = &segmentReadWriter{segmentReader: segmentReader{segment: scratch}}
+	return nil
+}
+
+// refresh catches a read-only WAL up with its writer, picking up records written to the scratch
+// segment since the last refresh, and segments published or deleted since. Records the writer has
+// discarded with TruncateBack are dropped, along with the cached ones.
+func (wal *WAL) refresh() error {
+	pubSegs, scratch, err := findSegments(wal.dir, &wal.opts, true)
+	if err != nil {
+		return err
+	}
+	if err := readTimeRanges(pubSegs, wal.pubSegs, wal.newPubReader); err != nil {
+		return err
+	}
+	firstInd, err := readFirstIndex(wal.opts.FS, wal.dir)
+	if err != nil {
+		return err
+	}
+	wal.pubSegs = pubSegs
+	wal.firstInd = firstInd
+
+	lastInd := wal.lastInd
+	srw := wal.scratchRW
+	same := scratch == srw.segment && srw.f != nil
+	truncated := false
+	if same && len(srw.offsets) > 0 {
+		// TruncateBack within the scratch segment leaves its seq and index as they were, so check
+		// that the last frame read is still there before reading on from it.
+		intact, err := srw.frameIntact(srw.offsets[len(srw.offsets)-1])
+		if err != nil {
+			return err
+		}
+		same, truncated = intact, !intact
+	}
+	if same {
+		// still the same scratch segment, so read on from where we left off
+		if wal.lastInd, _, err = srw.seekToLastFrameFrom(wal.lastInd); err != nil {
+			return err
+		}
+		srw.flushed = int64(srw.deframer.nBytes)
+		srw.synced = srw.flushed
+	} else {
+		// the scratch segment has been published (or created, or truncated) since
+		if srw.f != nil {
+			srw.segmentReader.Close()
+		}
+		// records may have been discarded, and written anew, so forget them all
+		wal.cache.truncateBack(0)
+		if err := wal.initReadOnlyScratch(scratch); err != nil {
+			return err
+		}
+	}
+	wal.durableInd = wal.lastInd
+	if truncated || wal.lastInd < lastInd {
+		atomic.AddUint64(&wal.truncations, 1)
+	}
+	if truncated || wal.lastInd != lastInd {
+		wal.notify()
+	}
+	return nil
 }
 
 func updateLastInd(wal *WAL, sr *segmentReader) error {
+	if sr.footer != nil {
+		wal.lastInd = sr.footer.lastInd
+		return nil
+	}
 	lastInd, _, err := sr.seekToLastFrame()
 	wal.lastInd = lastInd // cache to wal.lastInd
 	return err
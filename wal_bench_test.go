@@ -75,7 +75,7 @@ func benchmarkWrite(b *testing.B, nBytes int, batch int) {
 	}
 	defer os.RemoveAll(baseDir)
 	walDir := filepath.Join(baseDir, b.Name())
-	wal, err := OpenWAL(walDir, SegmentSizeBytes, nil)
+	wal, err := OpenWAL(walDir, nil)
 	if err != nil {
 		b.Fatal(err)
 	}
@@ -96,3 +96,32 @@ func benchmarkWrite(b *testing.B, nBytes int, batch int) {
 		}
 	}
 }
+
+func BenchmarkAppendSync_100B_Parallel16(b *testing.B) {
+	// Create a new WAL.
+	baseDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(baseDir)
+	walDir := filepath.Join(baseDir, b.Name())
+	wal, err := OpenWAL(walDir, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer wal.Close()
+
+	// Benchmark.
+	data := make([]byte, 100)
+	b.SetBytes(int64(frameSize(len(data))))
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := wal.AppendSync(data); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
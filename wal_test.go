@@ -1,18 +1,22 @@
 package wal
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
+	"syscall"
 	"testing"
+	"time"
 
 	"go.uber.org/zap"
 )
 
 const (
-	testSegmentSize = 100 // bytes
+	testSegmentSize = segmentHeaderSize + 100 // bytes: the header, and 100 bytes worth of frames
 )
 
 func Test_OpenWAL_Coverage(t *testing.T) {
@@ -25,7 +29,7 @@ func Test_OpenWAL_Coverage(t *testing.T) {
 	}
 	defer os.RemoveAll(baseDir)
 	walDir := filepath.Join(baseDir, "wal")
-	wal, err := OpenWAL(walDir, testSegmentSize, zap.NewExample())
+	wal, err := OpenWAL(walDir, &Options{SegmentSize: testSegmentSize, Logger: zap.NewExample()})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -51,16 +55,21 @@ func Test_OpenWAL_Coverage(t *testing.T) {
 	}
 
 	// Open the same WAL.
-	wal2, err := OpenWAL(walDir, testSegmentSize, zap.NewExample())
+	wal2, err := OpenWAL(walDir, &Options{SegmentSize: testSegmentSize, Logger: zap.NewExample()})
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(wal2.pubSegs) != 2 {
-		t.Fatalf("there weren't 2 published segments as expected; got:\n%#v", wal2.pubSegs)
+	// The 2nd segment should be resumed, rather than published.
+	if len(wal2.pubSegs) != 1 {
+		t.Fatalf("there wasn't 1 published segment as expected; got:\n%#v", wal2.pubSegs)
+	}
+	if wal2.scratchRW.segment.seq != 1 || wal2.LastIndex() != uint64(currInd) {
+		t.Fatalf("expected to resume the 2nd segment at index %d, but got %v at index %d",
+			currInd, wal2.scratchRW.segment, wal2.LastIndex())
 	}
 
 	// Write until reach 4th segment.
-	for len(wal2.pubSegs) == 2 {
+	for len(wal2.pubSegs) < 3 {
 		if _, err := wal2.Write(numAndInc(&currInd)); err != nil {
 			t.Fatal(err)
 		}
@@ -86,20 +95,20 @@ func Test_OpenWAL_Coverage(t *testing.T) {
 	}
 
 	// Open the WAL yet again.
-	wal3, err := OpenWAL(walDir, testSegmentSize, zap.NewExample())
+	wal3, err := OpenWAL(walDir, &Options{SegmentSize: testSegmentSize, Logger: zap.NewExample()})
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// Write to the scratch and sync.
-	if _, err := wal3.Write([]byte(fmt.Sprintf("%d", currInd))); err != nil {
+	if _, err := wal3.Write(numAndInc(&currInd)); err != nil {
 		t.Fatal(err)
 	}
 	if err := wal3.Sync(); err != nil {
 		t.Fatal(err)
 	}
 
-	// Every record excluding those presiding in scratch should be visitable.
+	// Every record, including those presiding in scratch, should be visitable.
 	i := 0
 	test := func(data []byte) error {
 		var err error
@@ -130,7 +139,7 @@ func Test_WAL_RecoverFromTornWrite(t *testing.T) {
 	}
 	defer os.RemoveAll(baseDir)
 	walDir := filepath.Join(baseDir, "wal")
-	wal, err := OpenWAL(walDir, testSegmentSize, zap.NewExample())
+	wal, err := OpenWAL(walDir, &Options{SegmentSize: testSegmentSize, Logger: zap.NewExample()})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -161,7 +170,7 @@ func Test_WAL_RecoverFromTornWrite(t *testing.T) {
 	}
 
 	// Subtract 1 byte from the 2nd record of the 2nd segment to simulate a torn write.
-	_, scratch, err := findSegments(walDir, testSegmentSize)
+	_, scratch, err := findSegments(walDir, &wal.opts, false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -170,7 +179,7 @@ func Test_WAL_RecoverFromTornWrite(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err := f.Truncate(bytesWritten - 1); err != nil {
+	if err := f.Truncate(segmentHeaderSize + bytesWritten - 1); err != nil {
 		t.Fatal(err)
 	}
 	if err := f.Close(); err != nil {
@@ -178,7 +187,7 @@ func Test_WAL_RecoverFromTornWrite(t *testing.T) {
 	}
 
 	// Open the WAL again.
-	wal2, err := OpenWAL(walDir, testSegmentSize, zap.NewExample())
+	wal2, err := OpenWAL(walDir, &Options{SegmentSize: testSegmentSize, Logger: zap.NewExample()})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -194,6 +203,336 @@ func Test_WAL_RecoverFromTornWrite(t *testing.T) {
 	if visited != 2 {
 		t.Fatalf("expected to visit 2 frames, but actually visited %d frame(s)", visited)
 	}
+	if wal2.LastIndex() != 2 {
+		t.Fatalf("expected last index to be 2, but got %d", wal2.LastIndex())
+	}
+	if ind, err := wal2.Append([]byte{45}); err != nil {
+		t.Fatal(err)
+	} else if ind != 3 {
+		t.Fatalf("expected the torn record's index to be reassigned, but got %d", ind)
+	}
+}
+
+func Test_WAL_Append(t *testing.T) {
+	// Create a new WAL.
+	baseDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(baseDir)
+	walDir := filepath.Join(baseDir, "wal")
+	wal, err := OpenWAL(walDir, &Options{SegmentSize: testSegmentSize, Logger: zap.NewExample()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wal.FirstIndex() != 1 || wal.LastIndex() != 0 {
+		t.Fatalf("expected a new WAL to span [1, 0], but got [%d, %d]", wal.FirstIndex(), wal.LastIndex())
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopening an empty WAL should not conjure up records from the preallocated scratch.
+	wal, err = OpenWAL(walDir, &Options{SegmentSize: testSegmentSize, Logger: zap.NewExample()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wal.LastIndex() != 0 {
+		t.Fatalf("expected the reopened WAL to be empty, but got last index %d", wal.LastIndex())
+	}
+
+	// Append across a couple of cuts, and across a reopen.
+	var want uint64 = 1
+	for len(wal.pubSegs) < 3 {
+		ind, err := wal.Append([]byte(fmt.Sprintf("%d", want)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ind != want {
+			t.Fatalf("expected index %d, but got %d", want, ind)
+		}
+		want++
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wal, err = OpenWAL(walDir, &Options{SegmentSize: testSegmentSize, Logger: zap.NewExample()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	if wal.LastIndex() != want-1 {
+		t.Fatalf("expected last index %d after reopening, but got %d", want-1, wal.LastIndex())
+	}
+	for len(wal.pubSegs) < 6 {
+		ind, err := wal.Append([]byte(fmt.Sprintf("%d", want)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ind != want {
+			t.Fatalf("expected index %d, but got %d", want, ind)
+		}
+		want++
+	}
+
+	// Every segment begins with the record whose index is in its name.
+	for _, seg := range wal.pubSegs {
+		it, err := wal.ReadFrom(seg.ind)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ind, data, err := it.Next()
+		it.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ind != seg.ind || string(data) != fmt.Sprintf("%d", seg.ind) {
+			t.Fatalf("segment %d should begin with record %d, but got %s", seg.seq, seg.ind, data)
+		}
+	}
+}
+
+func Test_WAL_Closed(t *testing.T) {
+	fs := NewMemFS()
+	opts := &Options{SegmentSize: testSegmentSize, FS: fs, SyncPolicy: SyncNever}
+	wal, err := OpenWAL("wal", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := wal.Append([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := wal.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every write, sync and truncation is refused, rather than lost.
+	var b Batch
+	b.Add([]byte("x"))
+	for name, f := range map[string]func() error{
+		"Write":         func() error { _, err := wal.Write([]byte("x")); return err },
+		"Append":        func() error { _, err := wal.Append([]byte("x")); return err },
+		"AppendRecord":  func() error { _, err := wal.AppendRecord(Record{Data: []byte("x")}); return err },
+		"AppendSync":    func() error { _, err := wal.AppendSync([]byte("x")); return err },
+		"WriteBatch":    func() error { _, err := wal.WriteBatch(&b); return err },
+		"Sync":          wal.Sync,
+		"TruncateFront": func() error { return wal.TruncateFront(2) },
+		"TruncateBack":  func() error { return wal.TruncateBack(1) },
+		"Close":         wal.Close,
+	} {
+		if err := f(); err != ErrClosed {
+			t.Fatalf("expected %s to return ErrClosed, but got %v", name, err)
+		}
+	}
+	if err := wal.Err(); err != nil {
+		t.Fatalf("expected the WAL not to have failed, but got %v", err)
+	}
+	if wal.LastIndex() != 3 {
+		t.Fatalf("expected last index 3, but got %d", wal.LastIndex())
+	}
+}
+
+func Test_OpenWAL_ResumeScratch(t *testing.T) {
+	// Create a new WAL.
+	baseDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(baseDir)
+	walDir := filepath.Join(baseDir, "wal")
+	opts := &Options{SegmentSize: testSegmentSize, Logger: zap.NewExample()}
+
+	// Reopening the WAL after every record shouldn't leave behind tiny published segments.
+	var n int
+	for i := 0; i < 3; i++ {
+		wal, err := OpenWAL(walDir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, err = wal.Write([]byte{byte(42 + i)}); err != nil {
+			t.Fatal(err)
+		}
+		if err := wal.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	segPaths, scratchPaths, err := getSegmentPaths(OS, walDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segPaths) != 0 || len(scratchPaths) != 1 {
+		t.Fatalf("expected a lone scratch segment, but got %v and %v", segPaths, scratchPaths)
+	}
+
+	// Tear off the end of the last record.
+	if err := os.Truncate(scratchPaths[0], int64(segmentHeaderSize+3*n-1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Records appended after resuming have to chain onto the rolling checksum of the last intact
+	// record, or else they won't survive another reopen.
+	wal, err := OpenWAL(walDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ind, err := wal.Append([]byte{45}); err != nil {
+		t.Fatal(err)
+	} else if ind != 3 {
+		t.Fatalf("expected the torn record's index to be reassigned, but got %d", ind)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wal, err = OpenWAL(walDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	var visited []byte
+	if err := wal.Visit(func(data []byte) error {
+		visited = append(visited, data...)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if string(visited) != string([]byte{42, 43, 45}) {
+		t.Fatalf("expected to visit [42 43 45], but visited %v", visited)
+	}
+}
+
+func Test_OpenWAL_Locked(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(baseDir)
+	walDir := filepath.Join(baseDir, "wal")
+	opts := &Options{SegmentSize: testSegmentSize, Logger: zap.NewExample()}
+
+	wal, err := OpenWAL(walDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenWAL(walDir, opts); err != ErrLocked {
+		t.Fatalf("expected ErrLocked, but got %v", err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The lock is released on Close, and also when OpenWAL fails part way through.
+	fs := NewMemFS()
+	memOpts := &Options{SegmentSize: testSegmentSize, FS: fs}
+	fs.SetFault(faultOn("List", "wal", os.ErrPermission))
+	if _, err := OpenWAL("wal", memOpts); !os.IsPermission(err) {
+		t.Fatalf("expected a permission error, but got %v", err)
+	}
+	fs.SetFault(nil)
+	for _, o := range []struct {
+		dir  string
+		opts *Options
+	}{{walDir, opts}, {"wal", memOpts}} {
+		wal, err := OpenWAL(o.dir, o.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := wal.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Test_WAL_WaitDurable(t *testing.T) {
+	fs := NewMemFS()
+	opts := &Options{SegmentSize: testSegmentSize, FS: fs}
+	wal, err := OpenWAL("wal", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	currInd := 0
+	for i := 0; i < 3; i++ {
+		if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if wal.DurableIndex() != 0 {
+		t.Fatalf("expected durable index 0, but got %d", wal.DurableIndex())
+	}
+
+	// waitDurable waits for index in the background.
+	waitDurable := func(ctx context.Context, index uint64) <-chan error {
+		errC := make(chan error, 1)
+		go func() {
+			errC <- wal.WaitDurable(ctx, index)
+		}()
+		return errC
+	}
+
+	// Waiting ends once the record is synced, or the context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := <-waitDurable(ctx, 2); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, but got %v", err)
+	}
+	errC := waitDurable(context.Background(), 2)
+	time.Sleep(10 * time.Millisecond)
+	if err := wal.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errC; err != nil {
+		t.Fatal(err)
+	}
+	if wal.DurableIndex() != 3 {
+		t.Fatalf("expected durable index 3, but got %d", wal.DurableIndex())
+	}
+
+	// Publishing a segment syncs it.
+	errC = waitDurable(context.Background(), 4)
+	for len(wal.pubSegs) == 0 {
+		if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-errC; err != nil {
+		t.Fatal(err)
+	}
+	if wal.DurableIndex() != wal.LastIndex() {
+		t.Fatalf("expected durable index %d, but got %d", wal.LastIndex(), wal.DurableIndex())
+	}
+
+	// Waiting also ends once the WAL fails, or is closed.
+	if _, err := wal.Write(numAndInc(&currInd)); err != nil {
+		t.Fatal(err)
+	}
+	errC = waitDurable(context.Background(), wal.LastIndex())
+	fs.SetFault(faultOn("Sync", ScratchSuffix, syscall.EIO))
+	if err := wal.Sync(); !errors.Is(err, syscall.EIO) {
+		t.Fatalf("expected EIO, but got %v", err)
+	}
+	if err := <-errC; !errors.Is(err, syscall.EIO) {
+		t.Fatalf("expected EIO, but got %v", err)
+	}
+	fs.SetFault(nil)
+	wal.Close()
+	wal, err = OpenWAL("wal", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wal.DurableIndex() != wal.LastIndex() {
+		t.Fatalf("expected every recovered record to be durable, but got %d of %d",
+			wal.DurableIndex(), wal.LastIndex())
+	}
+	errC = waitDurable(context.Background(), wal.LastIndex()+1)
+	time.Sleep(10 * time.Millisecond)
+	wal.Close()
+	if err := <-errC; err != ErrClosed {
+		t.Fatalf("expected ErrClosed, but got %v", err)
+	}
 }
 
 func numAndInc(x *int) []byte {